@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	// ErrNoCredentials denotes a request without the credentials an authenticator
+	// checks, which may be authenticated by another authenticator.
+	ErrNoCredentials = fmt.Errorf("no credentials")
+	// ErrUnauthenticated denotes a request that no authenticator accepted.
+	ErrUnauthenticated = status.Error(codes.Unauthenticated, "request is not authenticated")
+	// ErrPermissionDenied denotes a request the policy doesn't allow its principal to make.
+	ErrPermissionDenied = status.Error(codes.PermissionDenied, "principal is not allowed to make this request")
+)
+
+// Authenticator identifies the principal making a request.
+type Authenticator interface {
+	// Authenticate returns the principal making the request of ctx. ErrNoCredentials
+	// is returned if the request doesn't carry the credentials checked by the
+	// authenticator.
+	Authenticate(ctx context.Context) (string, error)
+}
+
+type principalKey struct{}
+
+// NewContext returns a copy of ctx carrying principal.
+func NewContext(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns the principal of an authenticated request.
+func FromContext(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(principalKey{}).(string)
+	return principal, ok
+}
+
+// incoming returns the values of key in the metadata of the request of ctx.
+func incoming(ctx context.Context, key string) []string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	return md.Get(key)
+}
+
+// MTLS authenticates the clients of a mutual TLS server by the common name of
+// their verified certificate.
+type MTLS struct{}
+
+func (MTLS) Authenticate(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return "", ErrNoCredentials
+	}
+	return info.State.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
+// apiKeyHeader is the metadata key carrying API keys.
+const apiKeyHeader = "x-api-key"
+
+// APIKeys authenticates requests by the static API key passed in their
+// x-api-key metadata.
+type APIKeys struct {
+	// principals maps every key to its principal.
+	principals map[string]string
+}
+
+// NewAPIKeys creates an authenticator accepting the key of every principal in
+// keys.
+func NewAPIKeys(keys map[string]string) *APIKeys {
+	principals := make(map[string]string, len(keys))
+	for principal, key := range keys {
+		principals[key] = principal
+	}
+	return &APIKeys{principals: principals}
+}
+
+func (a *APIKeys) Authenticate(ctx context.Context) (string, error) {
+	keys := incoming(ctx, apiKeyHeader)
+	if len(keys) == 0 {
+		return "", ErrNoCredentials
+	}
+
+	// Compare every key in constant time, so keys can't be guessed by timing.
+	var found string
+	for key, principal := range a.principals {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(keys[0])) == 1 {
+			found = principal
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("invalid api key")
+	}
+	return found, nil
+}
+
+// JWT authenticates requests by the subject of the signed bearer token passed in
+// their authorization metadata, such as an OIDC ID token.
+type JWT struct {
+	keys     jose.JSONWebKeySet
+	issuer   string
+	audience string
+}
+
+// NewJWT creates an authenticator accepting tokens issued by issuer for audience,
+// signed by one of the keys of the JWKS file jwks. Both issuer and audience are
+// required, so that tokens minted for other services are never accepted.
+func NewJWT(jwks, issuer, audience string) (*JWT, error) {
+	if issuer == "" || audience == "" {
+		return nil, fmt.Errorf("jwt authentication requires an issuer and an audience")
+	}
+
+	data, err := ioutil.ReadFile(jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &JWT{issuer: issuer, audience: audience}
+	if err := json.Unmarshal(data, &j.keys); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks %s: %v", jwks, err)
+	}
+	return j, nil
+}
+
+func (j *JWT) Authenticate(ctx context.Context) (string, error) {
+	var raw string
+	for _, value := range incoming(ctx, "authorization") {
+		if strings.HasPrefix(value, "Bearer ") {
+			raw = strings.TrimPrefix(value, "Bearer ")
+		}
+	}
+	if raw == "" {
+		return "", ErrNoCredentials
+	}
+
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return "", err
+	}
+
+	// Tokens naming their key are only checked against that key.
+	keys := j.keys.Keys
+	if len(token.Headers) > 0 && token.Headers[0].KeyID != "" {
+		keys = j.keys.Key(token.Headers[0].KeyID)
+	}
+
+	var claims jwt.Claims
+	verified := false
+	for _, key := range keys {
+		if err := token.Claims(key.Key, &claims); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", fmt.Errorf("token is not signed by a trusted key")
+	}
+
+	if err := claims.Validate(jwt.Expected{
+		Issuer:   j.issuer,
+		Audience: jwt.Audience{j.audience},
+		Time:     time.Now(),
+	}); err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// unauthenticated lists the services that can be called without credentials, so
+// that health checks and tools can reach the server.
+var unauthenticated = map[string]bool{
+	"grpc.health.v1.Health":                    true,
+	"grpc.reflection.v1alpha.ServerReflection": true,
+}
+
+// service returns the service of a full method name.
+func service(method string) string {
+	parts := strings.Split(strings.TrimPrefix(method, "/"), "/")
+	return parts[0]
+}
+
+// authenticate returns a copy of ctx carrying the principal accepted by the first
+// authenticator with credentials for the request.
+func authenticate(ctx context.Context, authenticators []Authenticator) (context.Context, error) {
+	for _, a := range authenticators {
+		principal, err := a.Authenticate(ctx)
+		switch {
+		case err == ErrNoCredentials:
+			continue
+		case err != nil:
+			return nil, status.Errorf(codes.Unauthenticated, "request is not authenticated: %v", err)
+		}
+		return NewContext(ctx, principal), nil
+	}
+	return nil, ErrUnauthenticated
+}
+
+// UnaryServerInterceptor authenticates every request with authenticators, and
+// checks that policy allows it, if set.
+func UnaryServerInterceptor(authenticators []Authenticator, policy *Policy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if unauthenticated[service(info.FullMethod)] {
+			return handler(ctx, req)
+		}
+
+		ctx, err := authenticate(ctx, authenticators)
+		if err != nil {
+			return nil, err
+		}
+		if policy != nil {
+			if err := policy.Authorize(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authorizedStream checks every message received on a stream against a policy.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	policy *Policy
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if s.policy != nil {
+		return s.policy.Authorize(s.ctx, m)
+	}
+	return nil
+}
+
+// StreamServerInterceptor authenticates every stream with authenticators, and
+// checks that policy allows every message received on it, if set.
+func StreamServerInterceptor(authenticators []Authenticator, policy *Policy) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if unauthenticated[service(info.FullMethod)] {
+			return handler(srv, ss)
+		}
+
+		ctx, err := authenticate(ss.Context(), authenticators)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authorizedStream{ServerStream: ss, ctx: ctx, policy: policy})
+	}
+}
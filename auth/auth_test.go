@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// withMetadata returns a context of an incoming request carrying the metadata
+// kv.
+func withMetadata(kv ...string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(kv...))
+}
+
+func TestAPIKeys(t *testing.T) {
+	a := NewAPIKeys(map[string]string{"alice": "secret-a", "bob": "secret-b"})
+
+	for _, c := range []struct {
+		ctx       context.Context
+		principal string
+		err       bool
+	}{
+		{withMetadata(apiKeyHeader, "secret-b"), "bob", false},
+		{withMetadata(apiKeyHeader, "wrong"), "", true},
+		{withMetadata(), "", true},
+	} {
+		principal, err := a.Authenticate(c.ctx)
+		if (err != nil) != c.err || principal != c.principal {
+			t.Fatalf("expected principal %q and error %v, instead: %q, %v", c.principal, c.err, principal, err)
+		}
+	}
+
+	if _, err := a.Authenticate(withMetadata()); err != ErrNoCredentials {
+		t.Fatalf("expected missing key to be ErrNoCredentials, instead: %v", err)
+	}
+}
+
+func TestMTLS(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "worker"}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}},
+	})
+
+	principal, err := MTLS{}.Authenticate(ctx)
+	if err != nil || principal != "worker" {
+		t.Fatalf("expected principal worker, instead: %q, %v", principal, err)
+	}
+
+	if _, err := (MTLS{}).Authenticate(context.Background()); err != ErrNoCredentials {
+		t.Fatalf("expected request without a peer to be ErrNoCredentials, instead: %v", err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &key.PublicKey, KeyID: "current", Algorithm: string(jose.ES256), Use: "sig"},
+	}})
+	if err != nil {
+		t.Fatalf("error marshalling jwks: %v", err)
+	}
+	file := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(file, jwks, 0600); err != nil {
+		t.Fatalf("error writing jwks: %v", err)
+	}
+
+	a, err := NewJWT(file, "https://issuer.example.com", "lock")
+	if err != nil {
+		t.Fatalf("error creating authenticator: %v", err)
+	}
+
+	// sign returns a bearer token for claims signed with k.
+	sign := func(k *ecdsa.PrivateKey, claims jwt.Claims) context.Context {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: k},
+			(&jose.SignerOptions{}).WithHeader("kid", "current"))
+		if err != nil {
+			t.Fatalf("error creating signer: %v", err)
+		}
+		token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		if err != nil {
+			t.Fatalf("error signing token: %v", err)
+		}
+		return withMetadata("authorization", "Bearer "+token)
+	}
+	valid := jwt.Claims{
+		Issuer:   "https://issuer.example.com",
+		Audience: jwt.Audience{"lock"},
+		Subject:  "scheduler",
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+
+	principal, err := a.Authenticate(sign(key, valid))
+	if err != nil || principal != "scheduler" {
+		t.Fatalf("expected principal scheduler, instead: %q, %v", principal, err)
+	}
+
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	wrongAudience := valid
+	wrongAudience.Audience = jwt.Audience{"other"}
+	wrongIssuer := valid
+	wrongIssuer.Issuer = "https://other.example.com"
+	noClaims := jwt.Claims{Subject: "scheduler", Expiry: valid.Expiry}
+	for name, ctx := range map[string]context.Context{
+		"untrusted key":  sign(other, valid),
+		"expired":        sign(key, expired),
+		"wrong audience": sign(key, wrongAudience),
+		"wrong issuer":   sign(key, wrongIssuer),
+		"unscoped":       sign(key, noClaims),
+	} {
+		if _, err := a.Authenticate(ctx); err == nil || err == ErrNoCredentials {
+			t.Fatalf("expected %s token to be rejected, instead: %v", name, err)
+		}
+	}
+
+	if _, err := a.Authenticate(withMetadata()); err != ErrNoCredentials {
+		t.Fatalf("expected missing token to be ErrNoCredentials, instead: %v", err)
+	}
+
+	// Tokens must always be scoped to an issuer and an audience.
+	if _, err := NewJWT(file, "https://issuer.example.com", ""); err == nil {
+		t.Fatalf("expected an authenticator without an audience to be rejected")
+	}
+	if _, err := NewJWT(file, "", "lock"); err == nil {
+		t.Fatalf("expected an authenticator without an issuer to be rejected")
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	interceptor := UnaryServerInterceptor([]Authenticator{MTLS{}, NewAPIKeys(map[string]string{"alice": "secret"})}, nil)
+
+	var principal string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		principal, _ = FromContext(ctx)
+		return nil, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/storage.LockService/TryLock"}
+
+	if _, err := interceptor(withMetadata(apiKeyHeader, "secret"), nil, info, handler); err != nil {
+		t.Fatalf("error calling handler: %v", err)
+	}
+	if principal != "alice" {
+		t.Fatalf("expected principal alice, instead: %q", principal)
+	}
+
+	for _, ctx := range []context.Context{withMetadata(), withMetadata(apiKeyHeader, "wrong")} {
+		if _, err := interceptor(ctx, nil, info, handler); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("expected request to be unauthenticated, instead: %v", err)
+		}
+	}
+
+	// Health checks don't need credentials.
+	health := &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}
+	if _, err := interceptor(withMetadata(), nil, health, handler); err != nil {
+		t.Fatalf("expected health check to be allowed, instead: %v", err)
+	}
+}
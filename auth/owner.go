@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	pb "github.com/gcp-services/lock/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrOwnerMismatch denotes a request for a lock whose owner isn't the principal
+// making it.
+var ErrOwnerMismatch = status.Error(codes.PermissionDenied, "lock owner doesn't match the authenticated principal")
+
+// OwnerMode is how the owners of locks are bound to the principals requesting
+// them.
+type OwnerMode string
+
+const (
+	// OwnerUnbound lets clients pass any owner.
+	OwnerUnbound OwnerMode = ""
+	// OwnerMatch requires the owner of every lock to be the principal requesting it.
+	OwnerMatch OwnerMode = "match"
+	// OwnerDerive sets the owner of locks requested without one to the principal
+	// requesting them, and otherwise requires it to match.
+	OwnerDerive OwnerMode = "derive"
+)
+
+// ParseOwnerMode parses the name of an owner mode.
+func ParseOwnerMode(mode string) (OwnerMode, error) {
+	switch m := OwnerMode(mode); m {
+	case OwnerUnbound, OwnerMatch, OwnerDerive:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid owner mode %q", mode)
+}
+
+// BindOwners returns a lock service binding the owners of the locks requested
+// from next to the authenticated principal, so that a client can't refresh,
+// release or transfer the locks of another. The new owner of a transferred lock is
+// not bound, as it is another principal.
+func BindOwners(next pb.LockServiceServer, mode OwnerMode) pb.LockServiceServer {
+	if mode == OwnerUnbound {
+		return next
+	}
+	return &boundService{LockServiceServer: next, mode: mode}
+}
+
+// boundService binds the owners of locks to principals. Methods without an owner
+// are passed through.
+type boundService struct {
+	pb.LockServiceServer
+	mode OwnerMode
+}
+
+// bindOwner checks owner against the principal of ctx, returning the owner bound
+// to the principal. The owner is set to the principal if it is empty and the mode
+// allows.
+func bindOwner(ctx context.Context, mode OwnerMode, owner string) (string, error) {
+	principal, ok := FromContext(ctx)
+	if !ok {
+		return "", ErrUnauthenticated
+	}
+
+	if owner == "" && mode == OwnerDerive {
+		owner = principal
+	}
+	if owner != principal {
+		return "", ErrOwnerMismatch
+	}
+	return owner, nil
+}
+
+// bind checks the owner of lock against the principal of ctx, setting it if the
+// mode allows.
+func (s *boundService) bind(ctx context.Context, lock *pb.Lock) error {
+	if lock == nil {
+		if _, ok := FromContext(ctx); !ok {
+			return ErrUnauthenticated
+		}
+		return nil
+	}
+
+	owner, err := bindOwner(ctx, s.mode, lock.Owner)
+	if err != nil {
+		return err
+	}
+	lock.Owner = owner
+	return nil
+}
+
+func (s *boundService) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	if err := s.bind(ctx, in.Lock); err != nil {
+		return nil, err
+	}
+	return s.LockServiceServer.TryLock(ctx, in)
+}
+
+func (s *boundService) Lock(ctx context.Context, in *pb.LockRequest) (*pb.LockResponse, error) {
+	if err := s.bind(ctx, in.Lock); err != nil {
+		return nil, err
+	}
+	return s.LockServiceServer.Lock(ctx, in)
+}
+
+func (s *boundService) Refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	if err := s.bind(ctx, in.Lock); err != nil {
+		return nil, err
+	}
+	return s.LockServiceServer.Refresh(ctx, in)
+}
+
+func (s *boundService) Transfer(ctx context.Context, in *pb.TransferRequest) (*pb.TransferResponse, error) {
+	if err := s.bind(ctx, in.Lock); err != nil {
+		return nil, err
+	}
+	return s.LockServiceServer.Transfer(ctx, in)
+}
+
+func (s *boundService) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	if err := s.bind(ctx, in.Lock); err != nil {
+		return nil, err
+	}
+	return s.LockServiceServer.Release(ctx, in)
+}
+
+func (s *boundService) Put(ctx context.Context, in *pb.PutRequest) (*pb.PutResponse, error) {
+	if err := s.bind(ctx, in.Lock); err != nil {
+		return nil, err
+	}
+	return s.LockServiceServer.Put(ctx, in)
+}
+
+func (s *boundService) Watch(in *pb.WatchRequest, stream pb.LockService_WatchServer) error {
+	if err := s.bind(stream.Context(), in.Lock); err != nil {
+		return err
+	}
+	return s.LockServiceServer.Watch(in, stream)
+}
+
+// BindCandidates returns an election service binding the candidates of the
+// elections requested from next to the authenticated principal, like the owners
+// of locks, so that a client can't resign the leadership of another.
+func BindCandidates(next pb.ElectionServiceServer, mode OwnerMode) pb.ElectionServiceServer {
+	if mode == OwnerUnbound {
+		return next
+	}
+	return &boundElections{ElectionServiceServer: next, mode: mode}
+}
+
+// boundElections binds the candidates of elections to principals. Methods without
+// a candidate are passed through.
+type boundElections struct {
+	pb.ElectionServiceServer
+	mode OwnerMode
+}
+
+func (s *boundElections) Campaign(ctx context.Context, in *pb.CampaignRequest) (*pb.CampaignResponse, error) {
+	candidate, err := bindOwner(ctx, s.mode, in.Candidate)
+	if err != nil {
+		return nil, err
+	}
+	in.Candidate = candidate
+	return s.ElectionServiceServer.Campaign(ctx, in)
+}
+
+func (s *boundElections) Resign(ctx context.Context, in *pb.ResignRequest) (*pb.ResignResponse, error) {
+	candidate, err := bindOwner(ctx, s.mode, in.Candidate)
+	if err != nil {
+		return nil, err
+	}
+	in.Candidate = candidate
+	return s.ElectionServiceServer.Resign(ctx, in)
+}
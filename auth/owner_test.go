@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/gcp-services/lock/storage"
+)
+
+// recordingService records the owner of the last lock it was asked for.
+type recordingService struct {
+	pb.LockServiceServer
+	owner string
+}
+
+func (s *recordingService) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	s.owner = in.Lock.Owner
+	return &pb.TryLockResponse{}, nil
+}
+
+func (s *recordingService) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	s.owner = in.Lock.Owner
+	return &pb.ReleaseResponse{}, nil
+}
+
+// recordingElections records the candidate of the last election it was asked for.
+type recordingElections struct {
+	pb.ElectionServiceServer
+	candidate string
+}
+
+func (s *recordingElections) Campaign(ctx context.Context, in *pb.CampaignRequest) (*pb.CampaignResponse, error) {
+	s.candidate = in.Candidate
+	return &pb.CampaignResponse{}, nil
+}
+
+func (s *recordingElections) Resign(ctx context.Context, in *pb.ResignRequest) (*pb.ResignResponse, error) {
+	s.candidate = in.Candidate
+	return &pb.ResignResponse{}, nil
+}
+
+func TestBindOwners(t *testing.T) {
+	ctx := NewContext(context.Background(), "scheduler")
+
+	for _, c := range []struct {
+		mode  OwnerMode
+		owner string
+		bound string
+		err   error
+	}{
+		{OwnerDerive, "", "scheduler", nil},
+		{OwnerDerive, "scheduler", "scheduler", nil},
+		{OwnerDerive, "billing", "", ErrOwnerMismatch},
+		{OwnerMatch, "scheduler", "scheduler", nil},
+		{OwnerMatch, "", "", ErrOwnerMismatch},
+		{OwnerUnbound, "billing", "billing", nil},
+	} {
+		next := &recordingService{}
+		svc := BindOwners(next, c.mode)
+
+		_, err := svc.TryLock(ctx, &pb.TryLockRequest{Lock: &pb.Lock{Uuid: "a", Owner: c.owner}})
+		if err != c.err {
+			t.Fatalf("expected %q locking as %q to return %v, instead: %v", c.mode, c.owner, c.err, err)
+		}
+		if next.owner != c.bound {
+			t.Fatalf("expected %q locking as %q to bind owner %q, instead: %q", c.mode, c.owner, c.bound, next.owner)
+		}
+	}
+
+	// Another principal can't release the lock.
+	next := &recordingService{}
+	svc := BindOwners(next, OwnerDerive)
+	other := NewContext(context.Background(), "billing")
+	if _, err := svc.Release(other, &pb.ReleaseRequest{Lock: &pb.Lock{Uuid: "a", Owner: "scheduler"}}); err != ErrOwnerMismatch {
+		t.Fatalf("expected release by another principal to return ErrOwnerMismatch, instead: %v", err)
+	}
+
+	if _, err := svc.Release(context.Background(), &pb.ReleaseRequest{Lock: &pb.Lock{Uuid: "a"}}); err != ErrUnauthenticated {
+		t.Fatalf("expected unauthenticated release to return ErrUnauthenticated, instead: %v", err)
+	}
+
+	if _, err := ParseOwnerMode("impersonate"); err == nil {
+		t.Fatalf("expected invalid owner mode to be rejected")
+	}
+}
+
+func TestBindCandidates(t *testing.T) {
+	ctx := NewContext(context.Background(), "scheduler")
+	next := &recordingElections{}
+	svc := BindCandidates(next, OwnerDerive)
+
+	if _, err := svc.Campaign(ctx, &pb.CampaignRequest{Name: "primary"}); err != nil {
+		t.Fatalf("error campaigning: %v", err)
+	}
+	if next.candidate != "scheduler" {
+		t.Fatalf("expected candidate to be derived from the principal, instead: %q", next.candidate)
+	}
+
+	// Another principal can't resign the leadership.
+	other := NewContext(context.Background(), "billing")
+	if _, err := svc.Resign(other, &pb.ResignRequest{Name: "primary", Candidate: "scheduler"}); err != ErrOwnerMismatch {
+		t.Fatalf("expected resign by another principal to return ErrOwnerMismatch, instead: %v", err)
+	}
+	if _, err := svc.Resign(context.Background(), &pb.ResignRequest{Name: "primary", Candidate: "scheduler"}); err != ErrUnauthenticated {
+		t.Fatalf("expected unauthenticated resign to return ErrUnauthenticated, instead: %v", err)
+	}
+
+	if BindCandidates(next, OwnerUnbound) != next {
+		t.Fatalf("expected unbound candidates to be passed through")
+	}
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	pb "github.com/gcp-services/lock/storage"
+	"gopkg.in/yaml.v2"
+)
+
+// Operations granted by policy rules.
+const (
+	// OpAcquire acquires, refreshes and writes locks, campaigns in elections and
+	// enters barriers and latches.
+	OpAcquire = "acquire"
+	// OpRelease releases and transfers locks, and resigns from elections.
+	OpRelease = "release"
+	// OpRead describes, lists and reads locks, their history and leaders. It is
+	// granted by every rule covering a lock.
+	OpRead = "read"
+	// OpAdmin grants every operation.
+	OpAdmin = "admin"
+)
+
+// Key prefixes of the locks backing elections, barriers and latches, which are
+// stored in the default namespace.
+const (
+	electionPrefix = "election/"
+	barrierPrefix  = "barrier/"
+	latchPrefix    = "latch/"
+)
+
+// anyNamespace matches every namespace in a rule.
+const anyNamespace = "*"
+
+// Rule grants operations on the locks of a namespace whose uuid starts with a
+// prefix.
+type Rule struct {
+	// Namespace is the namespace of the locks, empty for the default namespace or
+	// "*" for any namespace.
+	Namespace string `yaml:"namespace"`
+
+	// Prefix is the prefix of the uuids of the locks, matching every lock if empty.
+	Prefix string `yaml:"prefix"`
+
+	// Operations lists the operations granted on the locks.
+	Operations []string `yaml:"operations"`
+}
+
+// covers returns whether the rule applies to key in namespace.
+func (r *Rule) covers(namespace, key string) bool {
+	if r.Namespace != anyNamespace && r.Namespace != namespace {
+		return false
+	}
+	return strings.HasPrefix(key, r.Prefix)
+}
+
+// grants returns whether the rule grants op.
+func (r *Rule) grants(op string) bool {
+	if op == OpRead {
+		return true
+	}
+	for _, granted := range r.Operations {
+		if granted == op || granted == OpAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy authorizes the requests of authenticated principals. Principals without
+// rules can't make any request.
+type Policy struct {
+	Principals map[string][]*Rule `yaml:"principals"`
+}
+
+// LoadPolicy reads a policy from a YAML file. The file is parsed without viper,
+// which would lowercase the names of principals.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy %s: %v", file, err)
+	}
+
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %s: %v", file, err)
+	}
+
+	for principal, rules := range policy.Principals {
+		for _, rule := range rules {
+			for _, op := range rule.Operations {
+				switch op {
+				case OpAcquire, OpRelease, OpRead, OpAdmin:
+				default:
+					return nil, fmt.Errorf("invalid operation %q for principal %s", op, principal)
+				}
+			}
+		}
+	}
+	return policy, nil
+}
+
+// operation returns the operation requested by req, and the namespace and key of
+// the locks it applies to. Requests of unknown types require the admin operation.
+func operation(req interface{}) (op, namespace, key string) {
+	switch in := req.(type) {
+	case *pb.TryLockRequest:
+		return OpAcquire, in.Lock.GetNamespace(), in.Lock.GetUuid()
+	case *pb.LockRequest:
+		return OpAcquire, in.Lock.GetNamespace(), in.Lock.GetUuid()
+	case *pb.RefreshRequest:
+		return OpAcquire, in.Lock.GetNamespace(), in.Lock.GetUuid()
+	case *pb.PutRequest:
+		return OpAcquire, in.Lock.GetNamespace(), in.Lock.GetUuid()
+	case *pb.ReleaseRequest:
+		return OpRelease, in.Lock.GetNamespace(), in.Lock.GetUuid()
+	case *pb.TransferRequest:
+		return OpRelease, in.Lock.GetNamespace(), in.Lock.GetUuid()
+	case *pb.DescribeRequest:
+		return OpRead, in.Namespace, in.Uuid
+	case *pb.GetRequest:
+		return OpRead, in.Namespace, in.Uuid
+	case *pb.ListRequest:
+		return OpRead, in.Namespace, in.Prefix
+	case *pb.HistoryRequest:
+		return OpRead, in.Namespace, in.Uuid
+	case *pb.WatchRequest:
+		return OpRead, in.Lock.GetNamespace(), in.Lock.GetUuid()
+	case *pb.CampaignRequest:
+		return OpAcquire, "", electionPrefix + in.Name
+	case *pb.ResignRequest:
+		return OpRelease, "", electionPrefix + in.Name
+	case *pb.LeaderRequest:
+		return OpRead, "", electionPrefix + in.Name
+	case *pb.ObserveRequest:
+		return OpRead, "", electionPrefix + in.Name
+	case *pb.EnterRequest:
+		return OpAcquire, "", barrierPrefix + in.Name
+	case *pb.CountDownRequest:
+		return OpAcquire, "", latchPrefix + in.Name
+	case *pb.AwaitRequest:
+		return OpAcquire, "", latchPrefix + in.Name
+	}
+	return OpAdmin, "", ""
+}
+
+// Authorize checks that the principal of ctx is allowed to make req. The locks
+// listed by a List request must all be covered by a single rule, so its prefix
+// must start with the prefix of the rule.
+func (p *Policy) Authorize(ctx context.Context, req interface{}) error {
+	principal, ok := FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+
+	op, namespace, key := operation(req)
+	for _, rule := range p.Principals[principal] {
+		if rule.covers(namespace, key) && rule.grants(op) {
+			return nil
+		}
+	}
+	return ErrPermissionDenied
+}
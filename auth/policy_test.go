@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/gcp-services/lock/storage"
+)
+
+const testPolicy = `
+principals:
+  Scheduler:
+    - namespace: jobs
+      prefix: cron/
+      operations: [acquire, release]
+    - prefix: election/scheduler
+      operations: [acquire]
+  auditor:
+    - namespace: "*"
+      operations: [read]
+  operator:
+    - namespace: "*"
+      operations: [admin]
+`
+
+func TestPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(file, []byte(testPolicy), 0600); err != nil {
+		t.Fatalf("error writing policy: %v", err)
+	}
+	policy, err := LoadPolicy(file)
+	if err != nil {
+		t.Fatalf("error loading policy: %v", err)
+	}
+
+	for _, c := range []struct {
+		principal string
+		req       interface{}
+		err       error
+	}{
+		{"Scheduler", &pb.TryLockRequest{Lock: &pb.Lock{Uuid: "cron/daily", Namespace: "jobs"}}, nil},
+		{"Scheduler", &pb.ReleaseRequest{Lock: &pb.Lock{Uuid: "cron/daily", Namespace: "jobs"}}, nil},
+		{"Scheduler", &pb.DescribeRequest{Uuid: "cron/daily", Namespace: "jobs"}, nil},
+		{"Scheduler", &pb.ListRequest{Prefix: "cron/", Namespace: "jobs"}, nil},
+		{"Scheduler", &pb.HistoryRequest{Uuid: "cron/daily", Namespace: "jobs"}, nil},
+		{"Scheduler", &pb.WatchRequest{Lock: &pb.Lock{Uuid: "cron/daily", Namespace: "jobs"}}, nil},
+		{"Scheduler", &pb.ListRequest{Prefix: "", Namespace: "jobs"}, ErrPermissionDenied},
+		{"Scheduler", &pb.TryLockRequest{Lock: &pb.Lock{Uuid: "batch/daily", Namespace: "jobs"}}, ErrPermissionDenied},
+		{"Scheduler", &pb.TryLockRequest{Lock: &pb.Lock{Uuid: "cron/daily"}}, ErrPermissionDenied},
+		{"Scheduler", &pb.CampaignRequest{Name: "scheduler"}, nil},
+		{"Scheduler", &pb.ResignRequest{Name: "scheduler"}, ErrPermissionDenied},
+		{"Scheduler", &pb.EnterRequest{Name: "scheduler"}, ErrPermissionDenied},
+		{"scheduler", &pb.TryLockRequest{Lock: &pb.Lock{Uuid: "cron/daily", Namespace: "jobs"}}, ErrPermissionDenied},
+		{"auditor", &pb.GetRequest{Uuid: "anything", Namespace: "jobs"}, nil},
+		{"auditor", &pb.LeaderRequest{Name: "scheduler"}, nil},
+		{"auditor", &pb.RefreshRequest{Lock: &pb.Lock{Uuid: "anything"}}, ErrPermissionDenied},
+		{"operator", &pb.TransferRequest{Lock: &pb.Lock{Uuid: "cron/daily", Namespace: "jobs"}}, nil},
+		{"operator", &pb.CountDownRequest{Name: "deploy"}, nil},
+		{"unknown", &pb.DescribeRequest{Uuid: "cron/daily", Namespace: "jobs"}, ErrPermissionDenied},
+	} {
+		err := policy.Authorize(NewContext(context.Background(), c.principal), c.req)
+		if err != c.err {
+			t.Fatalf("expected %s making %T %v to return %v, instead: %v", c.principal, c.req, c.req, c.err, err)
+		}
+	}
+
+	if err := policy.Authorize(context.Background(), &pb.GetRequest{}); err != ErrUnauthenticated {
+		t.Fatalf("expected request without a principal to be unauthenticated, instead: %v", err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("principals:\n  x:\n    - operations: [delete]\n"), 0600); err != nil {
+		t.Fatalf("error writing policy: %v", err)
+	}
+	if _, err := LoadPolicy(file); err == nil {
+		t.Fatalf("expected policy with an invalid operation to be rejected")
+	}
+}
@@ -7,14 +7,29 @@ import (
 
 	pb "github.com/gcp-services/lock/storage"
 	"github.com/spf13/viper"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// watchStream collects the events sent on a watch stream.
+type watchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *pb.WatchEvent
+}
+
+func (s *watchStream) Context() context.Context { return s.ctx }
+
+func (s *watchStream) Send(event *pb.WatchEvent) error {
+	s.events <- event
+	return nil
+}
+
 type testBackend struct {
 	Name  string
 	Flags map[string]interface{}
-	Setup func() (pb.LockServiceServer, error)
+	Setup func() (Backend, error)
 }
 
 func testServer(t *testing.T, backend *testBackend) {
@@ -53,6 +68,17 @@ func testServer(t *testing.T, backend *testBackend) {
 		t.Fatalf("expected lock to be busy, instead: %v", err)
 	}
 
+	// Releasing a lock that does not exist succeeds, so releases can be retried.
+	released, err := svc.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:  "never-acquired",
+			Owner: "1234",
+		},
+	})
+	if err != nil || released.Holds != 0 {
+		t.Fatalf("expected release of a missing lock to succeed, instead: %v %v", released, err)
+	}
+
 	// Atempt to unlock with the incorrect owner.
 	if _, err = svc.Release(ctx, &pb.ReleaseRequest{
 		Lock: &pb.Lock{
@@ -125,6 +151,20 @@ func testServer(t *testing.T, backend *testBackend) {
 		t.Fatalf("lock should be busy, instead: %v", err)
 	}
 
+	// Waiting ends once the caller gives up, before the timeout is met.
+	cancelled, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+	defer cancel()
+	if _, err = svc.Lock(cancelled, &pb.LockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "1234",
+			Owner:   "1234",
+			Expires: timestamppb.New(expires),
+		},
+		Timeout: durationpb.New(time.Minute),
+	}); err != context.DeadlineExceeded {
+		t.Fatalf("expected lock to give up with the context, instead: %v", err)
+	}
+
 	expires = time.Now().Add(time.Second * 10)
 	// Try to lock and wait for the previous lock to expire.
 	if _, err = svc.Lock(ctx, &pb.LockRequest{
@@ -160,4 +200,658 @@ func testServer(t *testing.T, backend *testBackend) {
 	}); err != ErrLockNotFound {
 		t.Fatalf("error refreshing lock: %v", err)
 	}
+
+	// Acquire a reentrant lock twice with the same owner.
+	expires = time.Now().Add(time.Second * 30)
+	for holds := int64(1); holds <= 2; holds++ {
+		resp, err := svc.TryLock(ctx, &pb.TryLockRequest{
+			Lock: &pb.Lock{
+				Uuid:    "5678",
+				Owner:   "1234",
+				Expires: timestamppb.New(expires),
+			},
+			Reentrant: true,
+		})
+		if err != nil {
+			t.Fatalf("error trying to lock: %v", err)
+		}
+		if resp.Holds != holds {
+			t.Fatalf("expected %d holds, instead: %d", holds, resp.Holds)
+		}
+	}
+
+	// Reentrant locks are still exclusive to their owner.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "5678",
+			Owner:   "12345",
+			Expires: timestamppb.New(expires),
+		},
+		Reentrant: true,
+	}); err != ErrLockBusy {
+		t.Fatalf("expected lock to be busy, instead: %v", err)
+	}
+
+	// Every acquisition must be released before the lock is free.
+	for holds := int64(1); holds >= 0; holds-- {
+		resp, err := svc.Release(ctx, &pb.ReleaseRequest{
+			Lock: &pb.Lock{
+				Uuid:  "5678",
+				Owner: "1234",
+			},
+		})
+		if err != nil {
+			t.Fatalf("expected to unlock, instead: %v", err)
+		}
+		if resp.Holds != holds {
+			t.Fatalf("expected %d holds, instead: %d", holds, resp.Holds)
+		}
+	}
+
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "5678",
+			Owner:   "12345",
+			Expires: timestamppb.New(expires),
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	// Only the owner can transfer a lock.
+	if _, err = svc.Transfer(ctx, &pb.TransferRequest{
+		Lock: &pb.Lock{
+			Uuid:  "5678",
+			Owner: "1234",
+		},
+		NewOwner: "1234",
+		Expires:  timestamppb.New(expires),
+	}); err != ErrLockInvalidOwner {
+		t.Fatalf("expected transfer to fail with invalid owner, instead: %v", err)
+	}
+
+	// Hand the lock to a new owner.
+	if _, err = svc.Transfer(ctx, &pb.TransferRequest{
+		Lock: &pb.Lock{
+			Uuid:  "5678",
+			Owner: "12345",
+		},
+		NewOwner: "1234",
+		Expires:  timestamppb.New(expires),
+	}); err != nil {
+		t.Fatalf("error transferring lock: %v", err)
+	}
+
+	// The previous owner can no longer release the lock, but the new owner can.
+	if _, err = svc.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:  "5678",
+			Owner: "12345",
+		},
+	}); err != ErrLockInvalidOwner {
+		t.Fatalf("expected lock to fail with invalid owner, instead: %v", err)
+	}
+
+	if _, err = svc.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:  "5678",
+			Owner: "1234",
+		},
+	}); err != nil {
+		t.Fatalf("expected to unlock, instead: %v", err)
+	}
+
+	// Try to transfer a lock that doesn't exist.
+	if _, err = svc.Transfer(ctx, &pb.TransferRequest{
+		Lock: &pb.Lock{
+			Uuid:  "5678",
+			Owner: "1234",
+		},
+		NewOwner: "12345",
+		Expires:  timestamppb.New(expires),
+	}); err != ErrLockNotFound {
+		t.Fatalf("expected transfer to fail with not found, instead: %v", err)
+	}
+
+	// Acquire a preemptible lock.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:        "9012",
+			Owner:       "1234",
+			Expires:     timestamppb.New(expires),
+			Preemptible: true,
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	// Requests of the same priority can not preempt the lock.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "9012",
+			Owner:   "12345",
+			Expires: timestamppb.New(expires),
+		},
+	}); err != ErrLockBusy {
+		t.Fatalf("expected lock to be busy, instead: %v", err)
+	}
+
+	// The holder watches its lock, and sees it held.
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	defer cancelWatch()
+	watch := &watchStream{ctx: watchCtx, events: make(chan *pb.WatchEvent, 10)}
+	watched := make(chan error, 1)
+	go func() {
+		watched <- svc.Watch(&pb.WatchRequest{Lock: &pb.Lock{Uuid: "9012", Owner: "1234"}}, watch)
+	}()
+	if event := <-watch.events; event.Type != pb.WatchEvent_HELD || event.Lock.Owner != "1234" {
+		t.Fatalf("expected watch to see the lock held by 1234, instead: %v", event)
+	}
+
+	// A higher priority request revokes the lock from its owner.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "9012",
+			Owner:   "12345",
+			Expires: timestamppb.New(expires),
+		},
+		Priority: 1,
+	}); err != nil {
+		t.Fatalf("error preempting lock: %v", err)
+	}
+
+	// The holder is told its lock was revoked, and the watch ends.
+	if event := <-watch.events; event.Type != pb.WatchEvent_REVOKED || event.Lock.Owner != "12345" {
+		t.Fatalf("expected watch to see the lock revoked by 12345, instead: %v", event)
+	}
+	if err := <-watched; err != nil {
+		t.Fatalf("error watching lock: %v", err)
+	}
+
+	// Watching a lock held by another owner fails.
+	if err := svc.Watch(&pb.WatchRequest{Lock: &pb.Lock{Uuid: "9012", Owner: "1234"}}, watch); err != ErrLockInvalidOwner {
+		t.Fatalf("expected watch to fail with invalid owner, instead: %v", err)
+	}
+
+	if _, err = svc.Refresh(ctx, &pb.RefreshRequest{
+		Lock: &pb.Lock{
+			Uuid:    "9012",
+			Owner:   "1234",
+			Expires: timestamppb.New(expires.Add(time.Second)),
+		},
+	}); err != ErrLockInvalidOwner {
+		t.Fatalf("expected refresh to fail with invalid owner, instead: %v", err)
+	}
+
+	// Locks that are not preemptible can't be revoked.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "9012",
+			Owner:   "1234",
+			Expires: timestamppb.New(expires),
+		},
+		Priority: 2,
+	}); err != ErrLockBusy {
+		t.Fatalf("expected lock to be busy, instead: %v", err)
+	}
+
+	// Store labels and a payload with a lock.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "meta/1",
+			Owner:   "1234",
+			Expires: timestamppb.New(expires),
+			Labels:  map[string]string{"job": "backup"},
+			Payload: []byte("host-1"),
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	described, err := svc.Describe(ctx, &pb.DescribeRequest{Uuid: "meta/1"})
+	if err != nil {
+		t.Fatalf("error describing lock: %v", err)
+	}
+	if described.Lock.Owner != "1234" || described.Lock.Labels["job"] != "backup" || string(described.Lock.Payload) != "host-1" {
+		t.Fatalf("unexpected lock described: %v", described.Lock)
+	}
+
+	if _, err = svc.Describe(ctx, &pb.DescribeRequest{Uuid: "meta/0"}); err != ErrLockNotFound {
+		t.Fatalf("expected describe to fail with not found, instead: %v", err)
+	}
+
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "meta/2",
+			Owner:   "1234",
+			Expires: timestamppb.New(expires),
+			Payload: make([]byte, maxPayloadSize+1),
+		},
+	}); err != ErrPayloadTooLarge {
+		t.Fatalf("expected lock to fail with payload too large, instead: %v", err)
+	}
+
+	for _, uuid := range []string{"meta/2", "meta/3"} {
+		if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+			Lock: &pb.Lock{
+				Uuid:    uuid,
+				Owner:   "1234",
+				Expires: timestamppb.New(expires),
+			},
+		}); err != nil {
+			t.Fatalf("error trying to lock: %v", err)
+		}
+	}
+
+	// List the locks by prefix, two at a time.
+	var listed []string
+	req := &pb.ListRequest{Prefix: "meta/", PageSize: 2}
+	for {
+		resp, err := svc.List(ctx, req)
+		if err != nil {
+			t.Fatalf("error listing locks: %v", err)
+		}
+		if len(resp.Locks) > 2 {
+			t.Fatalf("expected at most 2 locks, instead: %d", len(resp.Locks))
+		}
+		for _, lock := range resp.Locks {
+			listed = append(listed, lock.Uuid)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+	if len(listed) != 3 || listed[0] != "meta/1" || listed[1] != "meta/2" || listed[2] != "meta/3" {
+		t.Fatalf("unexpected locks listed: %v", listed)
+	}
+
+	// Retried requests return the response of the request that was applied.
+	for i := 0; i < 2; i++ {
+		resp, err := svc.TryLock(ctx, &pb.TryLockRequest{
+			Lock: &pb.Lock{
+				Uuid:    "idempotent",
+				Owner:   "1234",
+				Expires: timestamppb.New(expires),
+			},
+			RequestId: "try-lock",
+		})
+		if err != nil {
+			t.Fatalf("error trying to lock: %v", err)
+		}
+		if resp.Holds != 1 {
+			t.Fatalf("expected lock to be held once, instead: %d", resp.Holds)
+		}
+	}
+
+	// Request ids are scoped to the owner of the request.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "idempotent",
+			Owner:   "12345",
+			Expires: timestamppb.New(expires),
+		},
+		RequestId: "try-lock",
+	}); err != ErrLockBusy {
+		t.Fatalf("expected lock to be busy, instead: %v", err)
+	}
+
+	release := &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:  "idempotent",
+			Owner: "1234",
+		},
+		RequestId: "release",
+	}
+	if _, err = svc.Release(ctx, release); err != nil {
+		t.Fatalf("error releasing lock: %v", err)
+	}
+
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "idempotent",
+			Owner:   "12345",
+			Expires: timestamppb.New(expires),
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	// A retried release doesn't fail, nor release the lock of its new owner.
+	if _, err = svc.Release(ctx, release); err != nil {
+		t.Fatalf("error retrying release: %v", err)
+	}
+
+	transfer := &pb.TransferRequest{
+		Lock: &pb.Lock{
+			Uuid:  "idempotent",
+			Owner: "12345",
+		},
+		NewOwner:  "1234",
+		Expires:   timestamppb.New(expires),
+		RequestId: "transfer",
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = svc.Transfer(ctx, transfer); err != nil {
+			t.Fatalf("error transferring lock: %v", err)
+		}
+	}
+
+	described, err = svc.Describe(ctx, &pb.DescribeRequest{Uuid: "idempotent"})
+	if err != nil {
+		t.Fatalf("error describing lock: %v", err)
+	}
+	if described.Lock.Owner != "1234" {
+		t.Fatalf("expected lock to be held by the new owner, instead: %v", described.Lock.Owner)
+	}
+
+	// Locks acquired with a token can only be used by callers presenting it.
+	acquired, err := svc.Lock(ctx, &pb.LockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "token",
+			Owner:   "shared-host",
+			Expires: timestamppb.New(expires),
+		},
+		Timeout:    durationpb.New(time.Second),
+		IssueToken: true,
+	})
+	if err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+	if acquired.Token == "" {
+		t.Fatalf("expected a token to be issued")
+	}
+
+	if _, err = svc.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:  "token",
+			Owner: "shared-host",
+		},
+	}); err != ErrLockInvalidOwner {
+		t.Fatalf("expected release without token to fail with invalid owner, instead: %v", err)
+	}
+
+	if _, err = svc.Refresh(ctx, &pb.RefreshRequest{
+		Lock: &pb.Lock{
+			Uuid:    "token",
+			Owner:   "shared-host",
+			Expires: timestamppb.New(expires.Add(time.Second)),
+			Token:   "guessed",
+		},
+	}); err != ErrLockInvalidOwner {
+		t.Fatalf("expected refresh with wrong token to fail with invalid owner, instead: %v", err)
+	}
+
+	if _, err = svc.Refresh(ctx, &pb.RefreshRequest{
+		Lock: &pb.Lock{
+			Uuid:    "token",
+			Owner:   "shared-host",
+			Expires: timestamppb.New(expires.Add(time.Second)),
+			Token:   acquired.Token,
+		},
+	}); err != nil {
+		t.Fatalf("error refreshing lock: %v", err)
+	}
+
+	// Tokens are not revealed to other callers.
+	described, err = svc.Describe(ctx, &pb.DescribeRequest{Uuid: "token"})
+	if err != nil {
+		t.Fatalf("error describing lock: %v", err)
+	}
+	if described.Lock.Token != "" {
+		t.Fatalf("expected token to be redacted, instead: %v", described.Lock.Token)
+	}
+
+	// The new owner of a transferred lock gets a token of its own.
+	transferred, err := svc.Transfer(ctx, &pb.TransferRequest{
+		Lock: &pb.Lock{
+			Uuid:  "token",
+			Owner: "shared-host",
+			Token: acquired.Token,
+		},
+		NewOwner: "other-host",
+		Expires:  timestamppb.New(expires),
+	})
+	if err != nil {
+		t.Fatalf("error transferring lock: %v", err)
+	}
+	if transferred.Token == "" || transferred.Token == acquired.Token {
+		t.Fatalf("expected a new token to be issued, instead: %v", transferred.Token)
+	}
+
+	if _, err = svc.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:  "token",
+			Owner: "other-host",
+			Token: transferred.Token,
+		},
+	}); err != nil {
+		t.Fatalf("error releasing lock: %v", err)
+	}
+
+	// Requests expecting an etag are only applied to the lock with that etag.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "cas",
+			Owner:   "1234",
+			Expires: timestamppb.New(expires),
+			Etag:    "missing",
+		},
+	}); err != ErrLockEtagMismatch {
+		t.Fatalf("expected lock to fail with etag mismatch, instead: %v", err)
+	}
+
+	locked, err := svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "cas",
+			Owner:   "1234",
+			Expires: timestamppb.New(expires),
+		},
+	})
+	if err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	described, err = svc.Describe(ctx, &pb.DescribeRequest{Uuid: "cas"})
+	if err != nil {
+		t.Fatalf("error describing lock: %v", err)
+	}
+	if locked.Etag == "" || described.Lock.Etag != locked.Etag {
+		t.Fatalf("expected etag %q, instead: %q", locked.Etag, described.Lock.Etag)
+	}
+
+	refreshed, err := svc.Refresh(ctx, &pb.RefreshRequest{
+		Lock: &pb.Lock{
+			Uuid:    "cas",
+			Owner:   "1234",
+			Expires: timestamppb.New(expires.Add(time.Second)),
+			Etag:    locked.Etag,
+		},
+	})
+	if err != nil {
+		t.Fatalf("error refreshing lock: %v", err)
+	}
+	if refreshed.Etag == "" || refreshed.Etag == locked.Etag {
+		t.Fatalf("expected refresh to change the etag, instead: %q", refreshed.Etag)
+	}
+
+	if _, err = svc.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:  "cas",
+			Owner: "1234",
+			Etag:  locked.Etag,
+		},
+	}); err != ErrLockEtagMismatch {
+		t.Fatalf("expected release to fail with etag mismatch, instead: %v", err)
+	}
+
+	if _, err = svc.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:  "cas",
+			Owner: "1234",
+			Etag:  refreshed.Etag,
+		},
+	}); err != nil {
+		t.Fatalf("error releasing lock: %v", err)
+	}
+
+	// The holder of a lock can store a value under it for others to read.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "kv",
+			Owner:   "1234",
+			Expires: timestamppb.New(expires),
+			Payload: []byte("leader"),
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	put, err := svc.Put(ctx, &pb.PutRequest{
+		Lock: &pb.Lock{
+			Uuid:  "kv",
+			Owner: "1234",
+		},
+		Value: []byte("10.0.0.1:8080"),
+	})
+	if err != nil {
+		t.Fatalf("error putting value: %v", err)
+	}
+
+	got, err := svc.Get(ctx, &pb.GetRequest{Uuid: "kv"})
+	if err != nil {
+		t.Fatalf("error getting value: %v", err)
+	}
+	if string(got.Value) != "10.0.0.1:8080" || got.Owner != "1234" || got.Etag != put.Etag {
+		t.Fatalf("unexpected value: %v", got)
+	}
+
+	// Values are stored apart from the payload of the lock.
+	described, err = svc.Describe(ctx, &pb.DescribeRequest{Uuid: "kv"})
+	if err != nil {
+		t.Fatalf("error describing lock: %v", err)
+	}
+	if string(described.Lock.Payload) != "leader" || len(described.Lock.Value) != 0 {
+		t.Fatalf("expected payload to be kept and value to be hidden, instead: %v", described.Lock)
+	}
+
+	if _, err = svc.Put(ctx, &pb.PutRequest{
+		Lock: &pb.Lock{
+			Uuid:  "kv",
+			Owner: "12345",
+		},
+		Value: []byte("10.0.0.2:8080"),
+	}); err != ErrLockInvalidOwner {
+		t.Fatalf("expected put to fail with invalid owner, instead: %v", err)
+	}
+
+	if _, err = svc.Put(ctx, &pb.PutRequest{
+		Lock: &pb.Lock{
+			Uuid:  "kv",
+			Owner: "1234",
+		},
+		Value: make([]byte, maxPayloadSize+1),
+	}); err != ErrPayloadTooLarge {
+		t.Fatalf("expected put to fail with payload too large, instead: %v", err)
+	}
+
+	// Values disappear along with the lease of their lock.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "kv-expired",
+			Owner:   "1234",
+			Expires: timestamppb.New(time.Now().Add(-time.Minute)),
+			Payload: []byte("stale"),
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	if _, err = svc.Get(ctx, &pb.GetRequest{Uuid: "kv-expired"}); err != ErrLockNotFound {
+		t.Fatalf("expected get to fail with not found, instead: %v", err)
+	}
+
+	if _, err = svc.Put(ctx, &pb.PutRequest{
+		Lock: &pb.Lock{
+			Uuid:  "kv-expired",
+			Owner: "1234",
+		},
+		Value: []byte("fresh"),
+	}); err != ErrLockExpired {
+		t.Fatalf("expected put to fail with expired, instead: %v", err)
+	}
+
+	// Locks that expire without being released are kept for their lock-delay.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "delayed",
+			Owner:     "1234",
+			Expires:   timestamppb.New(time.Now().Add(-time.Second * 5)),
+			LockDelay: durationpb.New(time.Minute),
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "delayed",
+			Owner:   "5678",
+			Expires: timestamppb.New(time.Now().Add(time.Minute)),
+		},
+	}); err != ErrLockBusy {
+		t.Fatalf("expected lock to fail with busy, instead: %v", err)
+	}
+
+	// The previous owner can take the lock back during the delay.
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "delayed",
+			Owner:     "1234",
+			Expires:   timestamppb.New(time.Now().Add(time.Minute)),
+			LockDelay: durationpb.New(time.Minute),
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	// Released locks are free right away.
+	if _, err = svc.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:  "delayed",
+			Owner: "1234",
+		},
+	}); err != nil {
+		t.Fatalf("error releasing lock: %v", err)
+	}
+
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:    "delayed",
+			Owner:   "5678",
+			Expires: timestamppb.New(time.Now().Add(time.Minute)),
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	if _, err = svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "delayed-long",
+			Owner:     "1234",
+			Expires:   timestamppb.New(time.Now().Add(time.Minute)),
+			LockDelay: durationpb.New(time.Hour),
+		},
+	}); err != ErrLockDelayTooLong {
+		t.Fatalf("expected lock to fail with lock delay too long, instead: %v", err)
+	}
+
+	testNamespaces(t, svc)
+	testMetrics(t, svc)
+	testTracing(t, svc)
+	testHealth(t, svc)
+	testWaitGraphClose(t, svc)
+	testElection(t, svc)
+	testBarrier(t, svc)
+	testAudit(t, svc)
 }
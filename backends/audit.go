@@ -0,0 +1,478 @@
+package backends
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gcp-services/lock/auth"
+	pb "github.com/gcp-services/lock/storage"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// auditWriteTimeout is how long an event has to be written to the audit log, even
+// once the request it belongs to was cancelled.
+const auditWriteTimeout = 5 * time.Second
+
+// AuditSink stores the events of an audit log. Events are only ever appended.
+type AuditSink interface {
+	// Write appends event to the log.
+	Write(ctx context.Context, event *pb.AuditEvent) error
+
+	// History returns up to limit events of the lock stored under uuid, newest
+	// first. Sinks that can't be read return ErrHistoryUnsupported.
+	History(ctx context.Context, uuid string, limit int) ([]*pb.AuditEvent, error)
+
+	// Close flushes the events written and releases the sink.
+	Close() error
+}
+
+// Audit is a backend recording the events of the locks of another backend in an
+// audit log. Events are recorded once the backend has applied them, with the
+// principal making the request, and a failure to record an event is logged rather
+// than failing the request it belongs to.
+type Audit struct {
+	Backend
+	sink AuditSink
+}
+
+// NewAudit creates a backend recording the events of the locks of next in sink.
+func NewAudit(next Backend, sink AuditSink) *Audit {
+	return &Audit{Backend: next, sink: sink}
+}
+
+// applied describes how a backend applied a request, for the Audit backend to
+// record it. Backends fill it in from the transaction applying the request, so
+// that it matches what was written.
+type applied struct {
+	// replayed is set when the request was a retry answered with the response
+	// recorded for its request id, and was not applied again.
+	replayed bool
+
+	// displaced is the lock an acquisition took from another owner, and expired
+	// whether it had expired by then.
+	displaced *pb.Lock
+	expired   bool
+}
+
+// appliedKey is the context key of the applied request.
+type appliedKey struct{}
+
+// withApplied returns a context in which backends describe how they applied a
+// request.
+func withApplied(ctx context.Context) (context.Context, *applied) {
+	a := &applied{}
+	return context.WithValue(ctx, appliedKey{}, a), a
+}
+
+// appliedFrom returns the description of the request of ctx, or nil if no one
+// asked for it. Its methods do nothing on nil.
+func appliedFrom(ctx context.Context) *applied {
+	a, _ := ctx.Value(appliedKey{}).(*applied)
+	return a
+}
+
+// reset clears the description before a backend attempts to apply the request,
+// as transactions can be retried.
+func (a *applied) reset() {
+	if a != nil {
+		*a = applied{}
+	}
+}
+
+// replay records that the request was answered with a recorded response.
+func (a *applied) replay() {
+	if a != nil {
+		a.replayed = true
+	}
+}
+
+// displace records that an acquisition took lock from its owner.
+func (a *applied) displace(lock *pb.Lock, expired bool) {
+	if a != nil {
+		a.displaced = lock
+		a.expired = expired
+	}
+}
+
+// record writes an event that happened now to the audit log. The event is written
+// even if the request is cancelled meanwhile, as it has already been applied.
+func (a *Audit) record(ctx context.Context, event *pb.AuditEvent) {
+	event.Time = timestamppb.Now()
+	if principal, ok := auth.FromContext(ctx); ok {
+		event.Principal = principal
+	}
+
+	ctx, cancel := context.WithTimeout(withoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+	if err := a.sink.Write(ctx, event); err != nil {
+		zap.L().Error("error writing audit event",
+			zap.String("uuid", event.Uuid),
+			zap.Stringer("type", event.Type),
+			zap.String("owner", event.Owner),
+			zap.Error(err),
+		)
+	}
+}
+
+// TryLock acquires a lock and records its acquisition. A lock taken from another
+// owner is first recorded as force released if it was preempted, or as expired.
+// Expired locks are only recorded once they are taken, and reentrant acquisitions
+// and retried requests are not recorded. The backend reports whom the lock was
+// taken from in the transaction acquiring it.
+func (a *Audit) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	ctx, applied := withApplied(ctx)
+	resp, err := a.Backend.TryLock(ctx, in)
+	if err != nil || resp.Holds > 1 || applied.replayed {
+		return resp, err
+	}
+
+	if previous := applied.displaced; previous != nil && previous.Owner != in.Lock.Owner {
+		event := &pb.AuditEvent{
+			Uuid:     in.Lock.Uuid,
+			Type:     pb.AuditEvent_FORCE_RELEASED,
+			Owner:    previous.Owner,
+			NewOwner: in.Lock.Owner,
+			Expires:  in.Lock.Expires,
+		}
+		if applied.expired {
+			event.Type = pb.AuditEvent_EXPIRED
+		}
+		a.record(ctx, event)
+	}
+
+	a.record(ctx, &pb.AuditEvent{
+		Uuid:    in.Lock.Uuid,
+		Type:    pb.AuditEvent_ACQUIRED,
+		Owner:   in.Lock.Owner,
+		Expires: in.Lock.Expires,
+	})
+	return resp, nil
+}
+
+// Lock awaits a lock, recording its acquisition like TryLock.
+func (a *Audit) Lock(ctx context.Context, in *pb.LockRequest) (*pb.LockResponse, error) {
+	return doLock(ctx, a, in)
+}
+
+// Refresh refreshes a lock and records its new expiry.
+func (a *Audit) Refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	ctx, applied := withApplied(ctx)
+	resp, err := a.Backend.Refresh(ctx, in)
+	if err != nil || applied.replayed {
+		return resp, err
+	}
+
+	a.record(ctx, &pb.AuditEvent{
+		Uuid:    in.Lock.Uuid,
+		Type:    pb.AuditEvent_REFRESHED,
+		Owner:   in.Lock.Owner,
+		Expires: in.Lock.Expires,
+	})
+	return resp, nil
+}
+
+// Transfer transfers a lock and records its new owner.
+func (a *Audit) Transfer(ctx context.Context, in *pb.TransferRequest) (*pb.TransferResponse, error) {
+	ctx, applied := withApplied(ctx)
+	resp, err := a.Backend.Transfer(ctx, in)
+	if err != nil || applied.replayed {
+		return resp, err
+	}
+
+	a.record(ctx, &pb.AuditEvent{
+		Uuid:     in.Lock.Uuid,
+		Type:     pb.AuditEvent_TRANSFERRED,
+		Owner:    in.Lock.Owner,
+		NewOwner: in.NewOwner,
+		Expires:  in.Expires,
+	})
+	return resp, nil
+}
+
+// Release releases a lock and records its release once it is no longer held.
+func (a *Audit) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	ctx, applied := withApplied(ctx)
+	resp, err := a.Backend.Release(ctx, in)
+	if err != nil || applied.replayed {
+		return resp, err
+	}
+
+	if resp.Holds == 0 {
+		a.record(ctx, &pb.AuditEvent{
+			Uuid:  in.Lock.Uuid,
+			Type:  pb.AuditEvent_RELEASED,
+			Owner: in.Lock.Owner,
+		})
+	}
+	return resp, nil
+}
+
+// Put stores a value under a lock and records the write.
+func (a *Audit) Put(ctx context.Context, in *pb.PutRequest) (*pb.PutResponse, error) {
+	ctx, applied := withApplied(ctx)
+	resp, err := a.Backend.Put(ctx, in)
+	if err != nil || applied.replayed {
+		return resp, err
+	}
+
+	a.record(ctx, &pb.AuditEvent{
+		Uuid:  in.Lock.Uuid,
+		Type:  pb.AuditEvent_PUT,
+		Owner: in.Lock.Owner,
+	})
+	return resp, nil
+}
+
+// History returns the events recorded for a lock, newest first.
+func (a *Audit) History(ctx context.Context, in *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	events, err := a.sink.History(ctx, in.Uuid, historySize(in))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.HistoryResponse{Events: events}, nil
+}
+
+// Close closes the audit sink, then the backend.
+func (a *Audit) Close() error {
+	if err := a.sink.Close(); err != nil {
+		return err
+	}
+	return a.Backend.Close()
+}
+
+// historySize returns the number of events to return for a request.
+func historySize(in *pb.HistoryRequest) int {
+	switch {
+	case in.PageSize <= 0:
+		return defaultPageSize
+	case in.PageSize > maxPageSize:
+		return maxPageSize
+	}
+	return int(in.PageSize)
+}
+
+// marshalEvent encodes an event as a line of JSON.
+func marshalEvent(event *pb.AuditEvent) ([]byte, error) {
+	line, err := protojson.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// writerAuditSink writes events to a writer as JSON lines.
+type writerAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterAuditSink creates a sink writing events to w, such as stdout, as JSON
+// lines. The history of locks can't be read back from it.
+func NewWriterAuditSink(w io.Writer) AuditSink {
+	return &writerAuditSink{w: w}
+}
+
+func (s *writerAuditSink) Write(ctx context.Context, event *pb.AuditEvent) error {
+	line, err := marshalEvent(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(line)
+	return err
+}
+
+func (s *writerAuditSink) History(ctx context.Context, uuid string, limit int) ([]*pb.AuditEvent, error) {
+	return nil, ErrHistoryUnsupported
+}
+
+func (s *writerAuditSink) Close() error {
+	return nil
+}
+
+// fileAuditSink appends events to a file as JSON lines, rotating it once it is
+// full.
+type fileAuditSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	// mu serializes writes to the current file and its rotation.
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileAuditSink creates a sink appending events to the file at path as JSON
+// lines. Once writing an event would grow the file beyond maxSize bytes, it is
+// renamed to path.1, older files are renamed to path.2 and so on, and files beyond
+// maxBackups are deleted. The file is never rotated if maxSize is zero.
+func NewFileAuditSink(path string, maxSize int64, maxBackups int) (AuditSink, error) {
+	s := &fileAuditSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the current file for appending.
+func (s *fileAuditSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// backup returns the path of the nth most recent rotated file.
+func (s *fileAuditSink) backup(n int) string {
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+// rotate moves the current file to the first backup, shifting older backups, and
+// opens a new current file.
+func (s *fileAuditSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if s.maxBackups > 0 {
+		for n := s.maxBackups - 1; n > 0; n-- {
+			if err := os.Rename(s.backup(n), s.backup(n+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(s.path, s.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileAuditSink) Write(ctx context.Context, event *pb.AuditEvent) error {
+	line, err := marshalEvent(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// openFiles opens the current file and every backup, newest first. The files are
+// opened together between two writes, so that they are scanned as they were then,
+// even if they are rotated during the scan.
+func (s *fileAuditSink) openFiles() ([]*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []*os.File
+	for n := 0; n <= s.maxBackups; n++ {
+		path := s.path
+		if n > 0 {
+			path = s.backup(n)
+		}
+
+		file, err := os.Open(path)
+		switch {
+		case os.IsNotExist(err):
+			return files, nil
+		case err != nil:
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// History scans the current file, then every backup, for the events of a lock. It
+// reads every event kept, so it is meant for occasional queries. Events are written,
+// and files rotated, while it scans.
+func (s *fileAuditSink) History(ctx context.Context, uuid string, limit int) ([]*pb.AuditEvent, error) {
+	files, err := s.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	var events []*pb.AuditEvent
+	for _, file := range files {
+		if len(events) >= limit {
+			break
+		}
+
+		written, err := readEvents(file, uuid)
+		if err != nil {
+			return nil, err
+		}
+
+		// Events are written oldest first.
+		for i := len(written) - 1; i >= 0 && len(events) < limit; i-- {
+			events = append(events, written[i])
+		}
+	}
+	return events, nil
+}
+
+func (s *fileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// readEvents returns the events of the lock stored under uuid in JSON lines, in the
+// order they were written. Lines that can't be decoded, such as a line cut short by
+// a crash, are skipped.
+func readEvents(r io.Reader, uuid string) ([]*pb.AuditEvent, error) {
+	var events []*pb.AuditEvent
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		event := &pb.AuditEvent{}
+		if err := protojson.Unmarshal(scanner.Bytes(), event); err != nil {
+			continue
+		}
+		if event.Uuid == uuid {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
@@ -0,0 +1,262 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gcp-services/lock/auth"
+	pb "github.com/gcp-services/lock/storage"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func testAudit(t *testing.T, backend Backend) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := NewFileAuditSink(filepath.Join(dir, "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatalf("error creating file audit sink: %v", err)
+	}
+	defer file.Close()
+	sinks := map[string]AuditSink{"file": file}
+	if sp, ok := backend.(*Spanner); ok {
+		sinks["spanner"] = sp.AuditSink()
+	}
+
+	if _, err := backend.History(context.Background(), &pb.HistoryRequest{Uuid: "audited"}); err != ErrAuditDisabled {
+		t.Fatalf("expected history to fail with audit disabled, instead: %v", err)
+	}
+
+	for name, sink := range sinks {
+		testAuditSink(t, &Audit{Backend: backend, sink: sink}, "audited-"+name)
+	}
+}
+
+// testAuditSink records the events of a lock with audit, and reads them back.
+func testAuditSink(t *testing.T, audit *Audit, uuid string) {
+	ctx := auth.NewContext(context.Background(), "scheduler")
+	expires := timestamppb.New(time.Now().Add(time.Minute))
+
+	if _, err := audit.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{Uuid: uuid, Owner: "a", Expires: expires, Preemptible: true},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	// Failed requests are not recorded.
+	if _, err := audit.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{Uuid: uuid, Owner: "b", Expires: expires},
+	}); err != ErrLockBusy {
+		t.Fatalf("expected lock to be busy, instead: %v", err)
+	}
+
+	if _, err := audit.TryLock(ctx, &pb.TryLockRequest{
+		Lock:     &pb.Lock{Uuid: uuid, Owner: "b", Expires: expires},
+		Priority: 1,
+	}); err != nil {
+		t.Fatalf("error preempting lock: %v", err)
+	}
+	if _, err := audit.Refresh(ctx, &pb.RefreshRequest{
+		Lock: &pb.Lock{Uuid: uuid, Owner: "b", Expires: timestamppb.New(expires.AsTime().Add(time.Second))},
+	}); err != nil {
+		t.Fatalf("error refreshing lock: %v", err)
+	}
+	if _, err := audit.Transfer(ctx, &pb.TransferRequest{
+		Lock:     &pb.Lock{Uuid: uuid, Owner: "b"},
+		NewOwner: "c",
+		Expires:  expires,
+	}); err != nil {
+		t.Fatalf("error transferring lock: %v", err)
+	}
+	if _, err := audit.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{Uuid: uuid, Owner: "c"},
+	}); err != nil {
+		t.Fatalf("error releasing lock: %v", err)
+	}
+
+	if _, err := audit.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{Uuid: uuid, Owner: "d", Expires: timestamppb.New(time.Now().Add(time.Millisecond * 100))},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	// Retries of a request are recorded once.
+	for i := 0; i < 2; i++ {
+		if _, err := audit.TryLock(ctx, &pb.TryLockRequest{
+			Lock:      &pb.Lock{Uuid: uuid, Owner: "e", Expires: expires},
+			RequestId: "retried",
+		}); err != nil {
+			t.Fatalf("error trying to lock expired lock: %v", err)
+		}
+	}
+
+	resp, err := audit.History(ctx, &pb.HistoryRequest{Uuid: uuid})
+	if err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+
+	expected := []struct {
+		event    pb.AuditEvent_Type
+		owner    string
+		newOwner string
+	}{
+		{pb.AuditEvent_ACQUIRED, "e", ""},
+		{pb.AuditEvent_EXPIRED, "d", "e"},
+		{pb.AuditEvent_ACQUIRED, "d", ""},
+		{pb.AuditEvent_RELEASED, "c", ""},
+		{pb.AuditEvent_TRANSFERRED, "b", "c"},
+		{pb.AuditEvent_REFRESHED, "b", ""},
+		{pb.AuditEvent_ACQUIRED, "b", ""},
+		{pb.AuditEvent_FORCE_RELEASED, "a", "b"},
+		{pb.AuditEvent_ACQUIRED, "a", ""},
+	}
+	if len(resp.Events) != len(expected) {
+		t.Fatalf("expected %d events, instead: %v", len(expected), resp.Events)
+	}
+	for i, e := range expected {
+		event := resp.Events[i]
+		if event.Uuid != uuid || event.Type != e.event || event.Owner != e.owner || event.NewOwner != e.newOwner {
+			t.Fatalf("expected event %d to be %v of %q to %q, instead: %v", i, e.event, e.owner, e.newOwner, event)
+		}
+		if event.Principal != "scheduler" || event.Time == nil {
+			t.Fatalf("expected event %d to be timed and made by scheduler, instead: %v", i, event)
+		}
+	}
+
+	if resp, err = audit.History(ctx, &pb.HistoryRequest{Uuid: uuid, PageSize: 2}); err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+	if len(resp.Events) != 2 || resp.Events[1].Type != pb.AuditEvent_EXPIRED {
+		t.Fatalf("expected the 2 newest events, instead: %v", resp.Events)
+	}
+
+	// The events of locks in a namespace are read back under their own uuid.
+	namespaces := NewNamespaces(audit, nil)
+	if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{Uuid: uuid, Namespace: "audit", Owner: "a", Expires: expires},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+	if resp, err = namespaces.History(ctx, &pb.HistoryRequest{Uuid: uuid, Namespace: "audit"}); err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+	if len(resp.Events) != 1 || resp.Events[0].Uuid != uuid {
+		t.Fatalf("expected one event of %q, instead: %v", uuid, resp.Events)
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every file holds two events before it is rotated.
+	path := filepath.Join(dir, "audit.log")
+	line, err := marshalEvent(&pb.AuditEvent{Uuid: "rotated", Type: pb.AuditEvent_REFRESHED, Owner: "0"})
+	if err != nil {
+		t.Fatalf("error encoding event: %v", err)
+	}
+	sink, err := NewFileAuditSink(path, int64(len(line)*2), 2)
+	if err != nil {
+		t.Fatalf("error creating file audit sink: %v", err)
+	}
+
+	for i := 0; i < 7; i++ {
+		if err := sink.Write(ctx, &pb.AuditEvent{Uuid: "rotated", Type: pb.AuditEvent_REFRESHED, Owner: strconv.Itoa(i)}); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+	}
+
+	// The oldest file was deleted, leaving the current file and two backups.
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("expected %s to exist, instead: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.log.3")); !os.IsNotExist(err) {
+		t.Fatalf("expected audit.log.3 to be deleted, instead: %v", err)
+	}
+
+	events, err := sink.History(ctx, "rotated", 100)
+	if err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+	if len(events) != 5 {
+		t.Fatalf("expected the 5 events kept, instead: %v", events)
+	}
+	for i, event := range events {
+		if expected := strconv.Itoa(6 - i); event.Owner != expected {
+			t.Fatalf("expected event %d to be owned by %s, instead: %v", i, expected, event)
+		}
+	}
+
+	if events, err = sink.History(ctx, "missing", 100); err != nil || len(events) != 0 {
+		t.Fatalf("expected no events of a missing lock, instead: %v %v", events, err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("error closing sink: %v", err)
+	}
+
+	// Events are appended to the existing file when it is reopened.
+	if sink, err = NewFileAuditSink(path, 1, 2); err != nil {
+		t.Fatalf("error reopening file audit sink: %v", err)
+	}
+	// Events are written, and files rotated, while the files are scanned.
+	files, err := sink.(*fileAuditSink).openFiles()
+	if err != nil {
+		t.Fatalf("error opening files: %v", err)
+	}
+	if err := sink.Write(ctx, &pb.AuditEvent{Uuid: "rotated", Type: pb.AuditEvent_RELEASED, Owner: "7"}); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+	scanned, err := readEvents(files[0], "rotated")
+	if err != nil || len(scanned) == 0 || scanned[len(scanned)-1].Owner != "6" {
+		t.Fatalf("expected the scanned file to end with the last event before rotation, instead: %v %v", scanned, err)
+	}
+	for _, file := range files {
+		file.Close()
+	}
+	if events, err = sink.History(ctx, "rotated", 2); err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+	if len(events) != 2 || events[0].Owner != "7" || events[1].Owner != "6" {
+		t.Fatalf("expected the new event before the last one written, instead: %v", events)
+	}
+	sink.Close()
+}
+
+func TestWriterAuditSink(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	sink := NewWriterAuditSink(&buf)
+
+	if err := sink.Write(ctx, &pb.AuditEvent{Uuid: "written", Type: pb.AuditEvent_ACQUIRED, Owner: "a"}); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+	event := &pb.AuditEvent{}
+	line, err := buf.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("expected a line of JSON, instead: %q", buf.String())
+	}
+	if err := protojson.Unmarshal(line, event); err != nil || event.Uuid != "written" {
+		t.Fatalf("expected a JSON line of the event, instead: %q %v", buf.String(), err)
+	}
+
+	if _, err := sink.History(ctx, "written", 1); err != ErrHistoryUnsupported {
+		t.Fatalf("expected history to fail with unsupported, instead: %v", err)
+	}
+}
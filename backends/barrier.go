@@ -0,0 +1,170 @@
+package backends
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// barrierPrefix keeps the counters backing barriers apart from latches.
+	barrierPrefix = "barrier/"
+	// latchPrefix keeps the counters backing latches apart from barriers.
+	latchPrefix = "latch/"
+	// leaveTimeout is how long a participant whose call failed has to leave its
+	// barrier, even once the call was cancelled.
+	leaveTimeout = 5 * time.Second
+)
+
+// Barrier implements distributed barriers and countdown latches on top of the
+// counters stored by a backend. A barrier is a counter incremented by each
+// participant that enters it, and a latch is a counter incremented by CountDown.
+// Both are released once their count reaches the requested target.
+type Barrier struct {
+	backend Backend
+
+	// closed is closed once blocked calls should be abandoned.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBarrier creates a new barrier service that stores barriers and latches in backend.
+func NewBarrier(backend Backend) *Barrier {
+	return &Barrier{
+		backend: backend,
+		closed:  make(chan struct{}),
+	}
+}
+
+// Close makes blocked Enter and Await calls fail with ErrShuttingDown, so that
+// their callers retry against another server. Participants of barriers leave them
+// again.
+func (b *Barrier) Close() {
+	b.closeOnce.Do(func() { close(b.closed) })
+}
+
+// newCounter creates the counter used when a barrier or latch is first used.
+func newCounter(name string, target int64, ttl *duration.Duration) (*pb.Counter, error) {
+	if target < 1 {
+		return nil, ErrInvalidCount
+	}
+
+	dur, err := ptypes.Duration(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.Counter{
+		Name:    name,
+		Target:  target,
+		Expires: timestamppb.New(time.Now().Add(dur)),
+	}, nil
+}
+
+// await blocks until the current state of counter reaches its target, or until
+// the timeout is met.
+func (b *Barrier) await(ctx context.Context, counter, current *pb.Counter, timeout time.Duration) (*pb.Counter, error) {
+	start := time.Now()
+	for current.Count < current.Target {
+		// Check if the maximum wait duration has expired.
+		if time.Now().After(start.Add(timeout)) {
+			return nil, ErrBarrierTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-b.closed:
+			return nil, ErrShuttingDown
+		case <-time.After(time.Second):
+		}
+
+		var err error
+		if current, err = b.backend.Count(ctx, counter, 0); err != nil {
+			return nil, err
+		}
+	}
+	return current, nil
+}
+
+// Enter enters a barrier and blocks until all participants have entered it, or
+// until the timeout is met. Participants whose call fails for any reason, including
+// timing out, being cancelled or being ended by Close, leave the barrier again.
+func (b *Barrier) Enter(ctx context.Context, in *pb.EnterRequest) (*pb.EnterResponse, error) {
+	counter, err := newCounter(barrierPrefix+in.Name, in.Participants, in.Ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	dur, err := optionalDuration(in.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := b.backend.Count(ctx, counter, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if current, err = b.await(ctx, counter, current, dur); err != nil {
+		// Leave even if the call was cancelled, so that the barrier doesn't count
+		// a participant that is gone.
+		leaveCtx, cancel := context.WithTimeout(withoutCancel(ctx), leaveTimeout)
+		defer cancel()
+		if _, leaveErr := b.backend.Count(leaveCtx, counter, -1); leaveErr != nil {
+			return nil, leaveErr
+		}
+		return nil, err
+	}
+
+	current.Name = in.Name
+	return &pb.EnterResponse{Barrier: current}, nil
+}
+
+// CountDown counts down a latch, releasing anyone awaiting it once it has been
+// counted down the requested number of times.
+func (b *Barrier) CountDown(ctx context.Context, in *pb.CountDownRequest) (*pb.CountDownResponse, error) {
+	counter, err := newCounter(latchPrefix+in.Name, in.Count, in.Ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := b.backend.Count(ctx, counter, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	current.Name = in.Name
+	return &pb.CountDownResponse{Latch: current}, nil
+}
+
+// Await blocks until a latch has been counted down the requested number of times,
+// or until the timeout is met.
+func (b *Barrier) Await(ctx context.Context, in *pb.AwaitRequest) (*pb.AwaitResponse, error) {
+	counter, err := newCounter(latchPrefix+in.Name, in.Count, in.Ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	dur, err := optionalDuration(in.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := b.backend.Count(ctx, counter, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if current, err = b.await(ctx, counter, current, dur); err != nil {
+		return nil, err
+	}
+
+	current.Name = in.Name
+	return &pb.AwaitResponse{Latch: current}, nil
+}
@@ -0,0 +1,137 @@
+package backends
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func testBarrier(t *testing.T, backend Backend) {
+	ctx := context.Background()
+	barrier := NewBarrier(backend)
+
+	// Counts must be positive.
+	if _, err := barrier.Enter(ctx, &pb.EnterRequest{
+		Name: "test",
+		Ttl:  durationpb.New(time.Second * 30),
+	}); err != ErrInvalidCount {
+		t.Fatalf("expected invalid count, instead: %v", err)
+	}
+
+	// A lone participant times out and leaves the barrier.
+	if _, err := barrier.Enter(ctx, &pb.EnterRequest{
+		Name:         "test",
+		Participants: 2,
+		Ttl:          durationpb.New(time.Second * 30),
+		Timeout:      durationpb.New(time.Millisecond * 100),
+	}); err != ErrBarrierTimeout {
+		t.Fatalf("expected barrier to time out, instead: %v", err)
+	}
+
+	// Two participants release each other. The in-memory Spanner server does not
+	// serialize read-write transactions, so participants arrive one at a time.
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		time.Sleep(time.Millisecond * 100)
+		go func() {
+			_, err := barrier.Enter(ctx, &pb.EnterRequest{
+				Name:         "test",
+				Participants: 2,
+				Ttl:          durationpb.New(time.Second * 30),
+				Timeout:      durationpb.New(time.Second * 4),
+			})
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("error entering barrier: %v", err)
+		}
+	}
+
+	// Awaiting a latch that hasn't been counted down times out.
+	if _, err := barrier.Await(ctx, &pb.AwaitRequest{
+		Name:    "test",
+		Count:   2,
+		Ttl:     durationpb.New(time.Second * 30),
+		Timeout: durationpb.New(time.Millisecond * 100),
+	}); err != ErrBarrierTimeout {
+		t.Fatalf("expected latch to time out, instead: %v", err)
+	}
+
+	for i := int64(1); i <= 2; i++ {
+		resp, err := barrier.CountDown(ctx, &pb.CountDownRequest{
+			Name:  "test",
+			Count: 2,
+			Ttl:   durationpb.New(time.Second * 30),
+		})
+		if err != nil {
+			t.Fatalf("error counting down latch: %v", err)
+		}
+		if resp.Latch.Count != i {
+			t.Fatalf("expected latch count %d, instead: %d", i, resp.Latch.Count)
+		}
+	}
+
+	// The latch has been counted down and is released immediately.
+	if _, err := barrier.Await(ctx, &pb.AwaitRequest{
+		Name:  "test",
+		Count: 2,
+		Ttl:   durationpb.New(time.Second * 30),
+	}); err != nil {
+		t.Fatalf("error awaiting latch: %v", err)
+	}
+
+	// Participants whose call is cancelled leave the barrier.
+	cancelled, cancel := context.WithCancel(ctx)
+	errs = make(chan error)
+	go func() {
+		_, err := barrier.Enter(cancelled, &pb.EnterRequest{
+			Name:         "cancelled",
+			Participants: 2,
+			Ttl:          durationpb.New(time.Second * 30),
+			Timeout:      durationpb.New(time.Minute),
+		})
+		errs <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected enter to fail with cancelled, instead: %v", err)
+	}
+	counter, err := backend.Count(ctx, &pb.Counter{Name: barrierPrefix + "cancelled", Target: 2}, 0)
+	if err != nil {
+		t.Fatalf("error reading barrier: %v", err)
+	}
+	if counter.Count != 0 {
+		t.Fatalf("expected cancelled participant to leave the barrier, instead: %d", counter.Count)
+	}
+
+	// Closing the barrier ends blocked calls, and their participants leave it.
+	errs = make(chan error)
+	go func() {
+		_, err := barrier.Enter(ctx, &pb.EnterRequest{
+			Name:         "closed",
+			Participants: 2,
+			Ttl:          durationpb.New(time.Second * 30),
+			Timeout:      durationpb.New(time.Minute),
+		})
+		errs <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+	barrier.Close()
+	if err := <-errs; err != ErrShuttingDown {
+		t.Fatalf("expected enter to fail with shutting down, instead: %v", err)
+	}
+	if _, err := barrier.Await(ctx, &pb.AwaitRequest{
+		Name:    "closed",
+		Count:   1,
+		Ttl:     durationpb.New(time.Second * 30),
+		Timeout: durationpb.New(time.Minute),
+	}); err != ErrShuttingDown {
+		t.Fatalf("expected await to fail with shutting down, instead: %v", err)
+	}
+}
@@ -3,7 +3,9 @@ package backends
 import (
 	"context"
 	"encoding/binary"
-	"log"
+	"encoding/json"
+	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/bigtable"
@@ -11,7 +13,11 @@ import (
 	"github.com/golang/protobuf/ptypes"
 	"github.com/google/uuid"
 	"github.com/spf13/viper"
+	"go.uber.org/zap"
 	"google.golang.org/api/option"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Bigtable service implements locks for a Bigtable backend.
@@ -41,6 +47,19 @@ func NewBigtable(ctx context.Context, project, instance string, opts ...option.C
 		return nil, err
 	}
 
+	if err := admin.CreateColumnFamily(ctx, viper.GetString("bigtable.table"), "Counters"); err != nil {
+		return nil, err
+	}
+
+	if err := admin.CreateColumnFamily(ctx, viper.GetString("bigtable.table"), "Requests"); err != nil {
+		return nil, err
+	}
+
+	// Responses recorded for retried requests are only kept briefly.
+	if err := admin.SetGCPolicy(ctx, viper.GetString("bigtable.table"), "Requests", bigtable.MaxAgePolicy(requestTTL)); err != nil {
+		return nil, err
+	}
+
 	return &Bigtable{
 		client: client,
 		admin:  admin,
@@ -48,32 +67,136 @@ func NewBigtable(ctx context.Context, project, instance string, opts ...option.C
 	}, nil
 }
 
-func (b *Bigtable) applyLock(ctx context.Context, tag string, in *pb.TryLockRequest) (bool, error) {
+// Close closes the clients of the Bigtable instance.
+func (b *Bigtable) Close() error {
+	if err := b.client.Close(); err != nil {
+		return err
+	}
+	return b.admin.Close()
+}
+
+// readLock reads the latest value of each column stored for a lock, keyed by
+// qualified column name. An empty map is returned when the lock does not exist.
+func (b *Bigtable) readLock(ctx context.Context, uuid string) (map[string][]byte, error) {
+	row, err := b.table.ReadRow(ctx, uuid, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte)
+	for _, column := range row["Locks"] {
+		values[column.Column] = column.Value
+	}
+	return values, nil
+}
+
+// decodeLock converts the stored values of a lock into a lock.
+func decodeLock(uuid string, values map[string][]byte) *pb.Lock {
+	lock := &pb.Lock{
+		Uuid:    uuid,
+		Owner:   string(values["Locks:owner"]),
+		Expires: timestamppb.New(time.Unix(int64(binary.BigEndian.Uint64(values["Locks:expires"])), 0)),
+	}
+	if acquired, ok := values["Locks:acquired"]; ok {
+		lock.Acquired = timestamppb.New(time.Unix(0, int64(binary.BigEndian.Uint64(acquired))))
+	}
+
+	// Locks written before the holds column existed are held once.
+	lock.Holds = 1
+	if holds, ok := values["Locks:holds"]; ok {
+		lock.Holds = int64(binary.BigEndian.Uint64(holds))
+	}
+
+	if priority, ok := values["Locks:priority"]; ok {
+		lock.Priority = int32(binary.BigEndian.Uint64(priority))
+	}
+	lock.Preemptible = string(values["Locks:preemptible"]) == "true"
+
+	// Labels are only written by applyLock, which always stores a valid JSON object.
+	if labels, ok := values["Locks:labels"]; ok {
+		_ = json.Unmarshal(labels, &lock.Labels)
+	}
+	lock.Payload = values["Locks:payload"]
+	lock.Value = values["Locks:value"]
+	lock.Token = string(values["Locks:token"])
+	lock.Etag = string(values["Locks:etag"])
+	if term, ok := values["Locks:term"]; ok {
+		lock.Term = int64(binary.BigEndian.Uint64(term))
+	}
+	if delay, ok := values["Locks:lock_delay"]; ok && binary.BigEndian.Uint64(delay) > 0 {
+		lock.LockDelay = durationpb.New(time.Duration(binary.BigEndian.Uint64(delay)))
+	}
+	return lock
+}
+
+// encodeInt encodes an integer column value.
+func encodeInt(v int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v))
+	return buf
+}
+
+// applyLock writes lock as the new state of the lock stored under its uuid with a
+// new etag, if the stored etag still matches tag. An empty tag only writes locks
+// that do not exist. The term of a fenced lock is also stored as the count of the
+// counter in its row, which is kept when the lock is released, and a fenced lock
+// that does not exist is only written if no later term has been given out.
+func (b *Bigtable) applyLock(ctx context.Context, tag string, lock *pb.Lock) (bool, error) {
 	var filter bigtable.Filter
 	if tag == "" {
 		filter = bigtable.ChainFilters(
 			bigtable.FamilyFilter("Locks"),
 		)
+		if lock.Term > 0 {
+			filter = bigtable.InterleaveFilters(filter, bigtable.ChainFilters(
+				bigtable.FamilyFilter("Counters"),
+				bigtable.ColumnFilter("count"),
+				bigtable.LatestNFilter(1),
+				bigtable.ValueRangeFilter(encodeInt(lock.Term), nil),
+			))
+		}
 	} else {
 		filter = bigtable.ChainFilters(
 			bigtable.FamilyFilter("Locks"),
 			bigtable.ColumnFilter("etag"),
+			bigtable.LatestNFilter(1),
 			bigtable.ValueFilter(tag),
 		)
 	}
 
-	ts, err := ptypes.Timestamp(in.Lock.Expires)
+	ts, err := ptypes.Timestamp(lock.Expires)
+	if err != nil {
+		return false, err
+	}
+
+	labels, err := json.Marshal(lock.Labels)
 	if err != nil {
 		return false, err
 	}
 
 	timeBuffer := make([]byte, 8)
 	binary.BigEndian.PutUint64(timeBuffer, uint64(ts.Unix()))
-	btime := bigtable.Time(ts)
+	// Cells are versioned by write time, so the latest version of every column
+	// holds the current state of the lock.
+	btime := bigtable.Now()
 	mut := bigtable.NewMutation()
-	mut.Set("Locks", "etag", btime, []byte(uuid.New().String()))
-	mut.Set("Locks", "owner", btime, []byte(in.Lock.Owner))
+	lock.Etag = uuid.New().String()
+	mut.Set("Locks", "etag", btime, []byte(lock.Etag))
+	mut.Set("Locks", "owner", btime, []byte(lock.Owner))
 	mut.Set("Locks", "expires", btime, timeBuffer)
+	mut.Set("Locks", "acquired", btime, encodeInt(lock.Acquired.AsTime().UnixNano()))
+	mut.Set("Locks", "holds", btime, encodeInt(lock.Holds))
+	mut.Set("Locks", "priority", btime, encodeInt(int64(lock.Priority)))
+	mut.Set("Locks", "preemptible", btime, []byte(strconv.FormatBool(lock.Preemptible)))
+	mut.Set("Locks", "labels", btime, labels)
+	mut.Set("Locks", "payload", btime, lock.Payload)
+	mut.Set("Locks", "token", btime, []byte(lock.Token))
+	mut.Set("Locks", "lock_delay", btime, encodeInt(int64(lock.LockDelay.AsDuration())))
+	mut.Set("Locks", "value", btime, lock.Value)
+	mut.Set("Locks", "term", btime, encodeInt(lock.Term))
+	if lock.Term > 0 {
+		mut.Set("Counters", "count", btime, encodeInt(lock.Term))
+	}
 	var condMut *bigtable.Mutation
 	if tag == "" {
 		condMut = bigtable.NewCondMutation(filter, nil, mut)
@@ -82,7 +205,7 @@ func (b *Bigtable) applyLock(ctx context.Context, tag string, in *pb.TryLockRequ
 	}
 
 	var matched bool
-	if err := b.table.Apply(ctx, in.Lock.Uuid, condMut, bigtable.GetCondMutationResult(&matched)); err != nil {
+	if err := b.table.Apply(ctx, lock.Uuid, condMut, bigtable.GetCondMutationResult(&matched)); err != nil {
 		return false, err
 	}
 
@@ -93,54 +216,162 @@ func (b *Bigtable) applyLock(ctx context.Context, tag string, in *pb.TryLockRequ
 	return matched, nil
 }
 
-// TryLock todo
+// idempotent returns the response recorded for the request identified by key, or
+// calls apply and records its response for the retries of the request. The
+// response is recorded after the request is applied, so a request that fails in
+// between is applied again when retried.
+func (b *Bigtable) idempotent(ctx context.Context, key string, resp proto.Message, apply func() (proto.Message, error)) error {
+	appliedFrom(ctx).reset()
+	if key == "" {
+		applied, err := apply()
+		if err != nil {
+			return err
+		}
+		proto.Merge(resp, applied)
+		return nil
+	}
+
+	row, err := b.table.ReadRow(ctx, key, bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.FamilyFilter("Requests"),
+		bigtable.LatestNFilter(1),
+	)))
+	if err != nil {
+		return err
+	}
+
+	for _, column := range row["Requests"] {
+		if column.Column == "Requests:response" && time.Since(column.Timestamp.Time()) < requestTTL {
+			appliedFrom(ctx).replay()
+			return proto.Unmarshal(column.Value, resp)
+		}
+	}
+
+	applied, err := apply()
+	if err != nil {
+		return err
+	}
+	proto.Merge(resp, applied)
+
+	recorded, err := proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	mut := bigtable.NewMutation()
+	mut.Set("Requests", "response", bigtable.Now(), recorded)
+	return b.table.Apply(ctx, key, mut)
+}
+
+// TryLock will attempt to acquire a lock. If a lock can not be acquired, the function
+// will return immediately with the reason for lock acquisition failure.
 func (b *Bigtable) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	resp := &pb.TryLockResponse{}
+	if err := b.idempotent(ctx, requestKey("TryLock", in.Lock, in.RequestId), resp, func() (proto.Message, error) {
+		return b.tryLock(ctx, in)
+	}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
 
-	// Try to apply the lock if the row doesn't exist.
-	applied, err := b.applyLock(ctx, "", in)
-	switch {
-	case err != nil:
+// tryLock makes a single attempt at acquiring a lock.
+func (b *Bigtable) tryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	if err := validateLock(in.Lock); err != nil {
 		return nil, err
-	case applied:
-		return &pb.TryLockResponse{}, nil
+	}
+
+	// Try to apply the lock if the row doesn't exist, unless the caller expects
+	// the lock to exist with a specific etag. Fenced locks need their term, which
+	// is read after the lock.
+	lock := newLock(in)
+	if in.Lock.GetEtag() == "" && !fenced(in.Lock.Uuid) {
+		applied, err := b.applyLock(ctx, "", lock)
+		switch {
+		case err != nil:
+			return nil, err
+		case applied:
+			return &pb.TryLockResponse{Holds: 1, Token: lock.Token, Etag: lock.Etag}, nil
+		}
 	}
 
 	// Read the row for this lock from Bigtable.
-	row, err := b.table.ReadRow(ctx, in.Lock.Uuid)
+	values, err := b.readLock(ctx, in.Lock.Uuid)
 	if err != nil {
 		return nil, err
 	}
+	if lock.Term, err = b.nextTerm(ctx, in.Lock.Uuid); err != nil {
+		return nil, err
+	}
 
 	// Row doesn't exist even though we (tried) to ensure it exists above.
-	if len(row) == 0 {
-		applied, err := b.applyLock(ctx, "", in)
+	if len(values) == 0 {
+		if err := checkEtag(in.Lock, nil); err != nil {
+			return nil, err
+		}
+		applied, err := b.applyLock(ctx, "", lock)
 		switch {
 		case err != nil:
 			return nil, err
 		case applied:
-			return &pb.TryLockResponse{}, nil
+			return &pb.TryLockResponse{Holds: 1, Token: lock.Token, Etag: lock.Etag}, nil
 		case !applied:
 			return nil, ErrLockBusy
 		}
 	}
 
-	// Read in the stored lock values.
-	values := make(map[string][]byte)
-	for _, column := range row["Locks"] {
-		values[column.Column] = column.Value
+	readLock := decodeLock(in.Lock.Uuid, values)
+	if err := checkEtag(in.Lock, readLock); err != nil {
+		return nil, err
 	}
 
 	// Decode the expiry time for the lock.
 	expires := time.Unix(int64(binary.BigEndian.Uint64(values["Locks:expires"])), 0)
-	log.Printf("expires is %v and intime is %v and now is %v", expires.Unix(), in.Lock.Expires.AsTime().Unix(), time.Now().Unix())
-	// Check if this lock can be applied, and try to do so.
+	zap.L().Debug("checking lock expiry",
+		zap.String("backend", "bigtable"),
+		zap.String("uuid", in.Lock.Uuid),
+		zap.String("owner", in.Lock.Owner),
+		zap.Time("expires", expires),
+		zap.Time("requested_expires", in.Lock.Expires.AsTime()),
+	)
+	// Check if this lock can be applied, and try to do so. Locks that expired
+	// without being released are kept from others during their lock-delay.
 	if time.Now().After(expires) {
-		applied, err := b.applyLock(ctx, string(values["Locks:etag"]), in)
+		if delayed(in, readLock) {
+			return nil, ErrLockBusy
+		}
+		applied, err := b.applyLock(ctx, string(values["Locks:etag"]), lock)
 		switch {
 		case err != nil:
 			return nil, err
 		case applied:
-			return &pb.TryLockResponse{}, nil
+			appliedFrom(ctx).displace(readLock, true)
+			return &pb.TryLockResponse{Holds: 1, Token: lock.Token, Etag: lock.Etag}, nil
+		}
+		return nil, ErrLockBusy
+	}
+
+	// Acquire the lock again if it is reentrant and already held by this owner,
+	// without shortening the current expiry.
+	if in.Reentrant && owns(in.Lock, readLock) {
+		lock := reentrantLock(in, readLock)
+		applied, err := b.applyLock(ctx, string(values["Locks:etag"]), lock)
+		switch {
+		case err != nil:
+			return nil, err
+		case applied:
+			return &pb.TryLockResponse{Holds: lock.Holds, Token: lock.Token, Etag: lock.Etag}, nil
+		}
+		return nil, ErrLockBusy
+	}
+
+	// Revoke the lock from its owner in favour of a more urgent request.
+	if preempts(in, readLock) {
+		applied, err := b.applyLock(ctx, string(values["Locks:etag"]), lock)
+		switch {
+		case err != nil:
+			return nil, err
+		case applied:
+			appliedFrom(ctx).displace(readLock, false)
+			return &pb.TryLockResponse{Holds: 1, Token: lock.Token, Etag: lock.Etag}, nil
 		}
 	}
 
@@ -153,40 +384,451 @@ func (b *Bigtable) Lock(ctx context.Context, in *pb.LockRequest) (*pb.LockRespon
 	return doLock(ctx, b, in)
 }
 
-func (b *Bigtable) Refresh(_ context.Context, _ *pb.RefreshRequest) (*pb.RefreshResponse, error) {
-	return nil, nil
-	//panic("not implemented") // TODO: Implement
+// Refresh will refresh a lock lease and extend the time a valid lock is held.
+func (b *Bigtable) Refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	resp := &pb.RefreshResponse{}
+	if err := b.idempotent(ctx, requestKey("Refresh", in.Lock, in.RequestId), resp, func() (proto.Message, error) {
+		return b.refresh(ctx, in)
+	}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// refresh extends the lease of a lock held by its owner.
+func (b *Bigtable) refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	values, err := b.readLock(ctx, in.Lock.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, ErrLockNotFound
+	}
+
+	readLock := decodeLock(in.Lock.Uuid, values)
+	if !owns(in.Lock, readLock) {
+		return nil, ErrLockInvalidOwner
+	}
+
+	if err := checkEtag(in.Lock, readLock); err != nil {
+		return nil, err
+	}
+
+	// Check if the refresh time is before the current expiry time.
+	ts, err := ptypes.Timestamp(in.Lock.Expires)
+	if err != nil {
+		return nil, err
+	}
+
+	if ts.Before(readLock.Expires.AsTime()) {
+		return nil, ErrLockInvalidRefresh
+	}
+
+	// Only apply the refresh if the lock has not changed hands since it was read.
+	lock := refreshLock(in, readLock)
+	applied, err := b.applyLock(ctx, string(values["Locks:etag"]), lock)
+	switch {
+	case err != nil:
+		return nil, err
+	case !applied:
+		return nil, ErrLockInvalidOwner
+	}
+
+	return &pb.RefreshResponse{Etag: lock.Etag}, nil
+}
+
+// Transfer hands a lock held by its current owner to a new owner, without the lock
+// becoming free in between.
+func (b *Bigtable) Transfer(ctx context.Context, in *pb.TransferRequest) (*pb.TransferResponse, error) {
+	resp := &pb.TransferResponse{}
+	if err := b.idempotent(ctx, requestKey("Transfer", in.Lock, in.RequestId), resp, func() (proto.Message, error) {
+		return b.transfer(ctx, in)
+	}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// transfer hands a lock to its new owner if it is still held by its current owner.
+func (b *Bigtable) transfer(ctx context.Context, in *pb.TransferRequest) (*pb.TransferResponse, error) {
+	values, err := b.readLock(ctx, in.Lock.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, ErrLockNotFound
+	}
+
+	readLock := decodeLock(in.Lock.Uuid, values)
+	if !owns(in.Lock, readLock) {
+		return nil, ErrLockInvalidOwner
+	}
+
+	if err := checkEtag(in.Lock, readLock); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(readLock.Expires.AsTime()) {
+		return nil, ErrLockExpired
+	}
+
+	// The new owner holds the lock once, starting now. The transfer is only applied
+	// if the lock has not changed hands since it was read.
+	lock := transferLock(in, readLock)
+	if lock.Term, err = b.nextTerm(ctx, in.Lock.Uuid); err != nil {
+		return nil, err
+	}
+	applied, err := b.applyLock(ctx, string(values["Locks:etag"]), lock)
+	switch {
+	case err != nil:
+		return nil, err
+	case !applied:
+		return nil, ErrLockInvalidOwner
+	}
+
+	return &pb.TransferResponse{Token: lock.Token, Etag: lock.Etag}, nil
+}
+
+// Put replaces the value stored under a lock held by its owner.
+func (b *Bigtable) Put(ctx context.Context, in *pb.PutRequest) (*pb.PutResponse, error) {
+	resp := &pb.PutResponse{}
+	if err := b.idempotent(ctx, requestKey("Put", in.Lock, in.RequestId), resp, func() (proto.Message, error) {
+		return b.put(ctx, in)
+	}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// put replaces the value stored under a lock if it is still held by its owner.
+func (b *Bigtable) put(ctx context.Context, in *pb.PutRequest) (*pb.PutResponse, error) {
+	values, err := b.readLock(ctx, in.Lock.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, ErrLockNotFound
+	}
+
+	readLock := decodeLock(in.Lock.Uuid, values)
+	if !owns(in.Lock, readLock) {
+		return nil, ErrLockInvalidOwner
+	}
+
+	if err := checkEtag(in.Lock, readLock); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(readLock.Expires.AsTime()) {
+		return nil, ErrLockExpired
+	}
+
+	lock := putLock(in, readLock)
+	if err := validateLock(lock); err != nil {
+		return nil, err
+	}
+
+	// Only apply the value if the lock has not changed hands since it was read.
+	applied, err := b.applyLock(ctx, string(values["Locks:etag"]), lock)
+	switch {
+	case err != nil:
+		return nil, err
+	case !applied:
+		return nil, ErrLockInvalidOwner
+	}
+
+	return &pb.PutResponse{Etag: lock.Etag}, nil
+}
+
+// Get returns the value stored under a lock, while the lock is held.
+func (b *Bigtable) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	return doGet(ctx, b, in)
 }
 
 // Release will release a lock that was previously acquired.
 func (b *Bigtable) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
-	row, err := b.table.ReadRow(ctx, in.Lock.Uuid)
+	resp := &pb.ReleaseResponse{}
+	if err := b.idempotent(ctx, requestKey("Release", in.Lock, in.RequestId), resp, func() (proto.Message, error) {
+		return b.release(ctx, in)
+	}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// release gives up a single hold of a lock held by its owner.
+func (b *Bigtable) release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	values, err := b.readLock(ctx, in.Lock.Uuid)
 	if err != nil {
 		return nil, err
 	}
 
-	values := make(map[string][]byte)
-	for _, column := range row["Locks"] {
-		values[column.Column] = column.Value
+	// Releasing a lock that no longer exists succeeds, so that a release retried
+	// after its response was lost does not fail.
+	if len(values) == 0 {
+		if err := checkEtag(in.Lock, nil); err != nil {
+			return nil, err
+		}
+		return &pb.ReleaseResponse{}, nil
 	}
 
-	if string(values["Locks:owner"]) != in.Lock.Owner {
+	readLock := decodeLock(in.Lock.Uuid, values)
+	if !owns(in.Lock, readLock) {
 		return nil, ErrLockInvalidOwner
 	}
 
+	if err := checkEtag(in.Lock, readLock); err != nil {
+		return nil, err
+	}
+
+	// Keep reentrant locks that are still held by their owner.
+	if holds := readLock.Holds; holds > 1 {
+		filter := bigtable.ChainFilters(
+			bigtable.FamilyFilter("Locks"),
+			bigtable.ColumnFilter("etag"),
+			bigtable.LatestNFilter(1),
+			bigtable.ValueFilter(string(values["Locks:etag"])),
+		)
+		etag := uuid.New().String()
+		btime := bigtable.Now()
+		m := bigtable.NewMutation()
+		m.Set("Locks", "etag", btime, []byte(etag))
+		m.Set("Locks", "holds", btime, encodeInt(holds-1))
+		condMut := bigtable.NewCondMutation(filter, m, nil)
+		var matched bool
+		if err := b.table.Apply(ctx, in.Lock.Uuid, condMut, bigtable.GetCondMutationResult(&matched)); err != nil {
+			return nil, err
+		}
+		if !matched {
+			return nil, ErrLockInvalidOwner
+		}
+		return &pb.ReleaseResponse{Holds: holds - 1, Etag: etag}, nil
+	}
+
 	filter := bigtable.ChainFilters(
 		bigtable.FamilyFilter("Locks"),
 		bigtable.ColumnFilter("owner"),
+		bigtable.LatestNFilter(1),
 		bigtable.ValueFilter(in.Lock.Owner),
 	)
+
+	// Locks with a token could have been acquired again by the same owner since
+	// they were read, so only delete them if they are unchanged. The same goes for
+	// callers expecting an etag.
+	casRelease := readLock.Token != "" || in.Lock.GetEtag() != ""
+	if casRelease {
+		filter = bigtable.ChainFilters(
+			bigtable.FamilyFilter("Locks"),
+			bigtable.ColumnFilter("etag"),
+			bigtable.LatestNFilter(1),
+			bigtable.ValueFilter(string(values["Locks:etag"])),
+		)
+	}
 	m := bigtable.NewMutation()
-	m.DeleteRow()
+	m.DeleteCellsInFamily("Locks")
 	condMut := bigtable.NewCondMutation(filter, m, nil)
 	var matched bool
 	opt := bigtable.GetCondMutationResult(&matched)
 	if err := b.table.Apply(ctx, in.Lock.Uuid, condMut, opt); err != nil {
 		return nil, err
 	}
-	log.Printf("matched is %v\n", matched)
+	zap.L().Debug("released lock",
+		zap.String("backend", "bigtable"),
+		zap.String("uuid", in.Lock.Uuid),
+		zap.String("owner", in.Lock.Owner),
+		zap.Bool("matched", matched),
+	)
+	switch {
+	case !casRelease || matched:
+		break
+	case in.Lock.GetEtag() != "":
+		return nil, ErrLockEtagMismatch
+	default:
+		return nil, ErrLockInvalidOwner
+	}
 	return &pb.ReleaseResponse{}, nil
 }
+
+// History returns ErrAuditDisabled, as the events of locks are only recorded by an
+// Audit backend.
+func (b *Bigtable) History(ctx context.Context, in *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	return nil, ErrAuditDisabled
+}
+
+// Watch streams the changes of a lock to its holder until it is lost.
+func (b *Bigtable) Watch(in *pb.WatchRequest, stream pb.LockService_WatchServer) error {
+	return doWatch(b, in, stream, nil)
+}
+
+// Read returns the lock currently stored under uuid, whether or not it has expired.
+func (b *Bigtable) Read(ctx context.Context, uuid string) (*pb.Lock, error) {
+	values, err := b.readLock(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, ErrLockNotFound
+	}
+	return decodeLock(uuid, values), nil
+}
+
+// Describe returns the lock currently stored under a uuid, including its labels
+// and payload.
+func (b *Bigtable) Describe(ctx context.Context, in *pb.DescribeRequest) (*pb.DescribeResponse, error) {
+	return doDescribe(ctx, b, in)
+}
+
+// List returns the locks stored under uuids starting with a prefix, in uuid order.
+// Locks are listed whether or not they have expired.
+func (b *Bigtable) List(ctx context.Context, in *pb.ListRequest) (*pb.ListResponse, error) {
+	limit := pageSize(in)
+
+	// Start from the prefix, or from just after the last lock of the previous page.
+	rows := bigtable.PrefixRange(in.Prefix)
+	if in.PageToken != "" {
+		rows = bigtable.InfiniteRange(in.PageToken + "\x00")
+	}
+
+	// Rows holding only counters have no cells left after filtering, and are skipped.
+	resp := &pb.ListResponse{}
+	if err := b.table.ReadRows(ctx, rows, func(row bigtable.Row) bool {
+		// Rows are read in key order, so no further row can match the prefix.
+		if !strings.HasPrefix(row.Key(), in.Prefix) {
+			return false
+		}
+
+		if len(resp.Locks) == limit {
+			resp.NextPageToken = resp.Locks[limit-1].Uuid
+			return false
+		}
+
+		values := make(map[string][]byte)
+		for _, column := range row["Locks"] {
+			values[column.Column] = column.Value
+		}
+		resp.Locks = append(resp.Locks, redactLock(decodeLock(row.Key(), values)))
+		return true
+	}, bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.FamilyFilter("Locks"),
+		bigtable.LatestNFilter(1),
+	)), bigtable.LimitRows(int64(limit+1))); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// readCounter reads the latest value of each column stored for a counter, keyed
+// by qualified column name. An empty map is returned when the counter does not exist.
+func (b *Bigtable) readCounter(ctx context.Context, name string) (map[string][]byte, error) {
+	row, err := b.table.ReadRow(ctx, name, bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.FamilyFilter("Counters"),
+		bigtable.LatestNFilter(1),
+	)))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte)
+	for _, column := range row["Counters"] {
+		values[column.Column] = column.Value
+	}
+	return values, nil
+}
+
+// nextTerm returns the term a lock stored under uuid is given when it is taken by a
+// new owner, or zero if the lock is not fenced. Terms are read after the lock, so
+// that a lock written with the etag it was read with has not been given a later
+// term since.
+func (b *Bigtable) nextTerm(ctx context.Context, uuid string) (int64, error) {
+	if !fenced(uuid) {
+		return 0, nil
+	}
+
+	values, err := b.readCounter(ctx, uuid)
+	if err != nil {
+		return 0, err
+	}
+	if count, ok := values["Counters:count"]; ok {
+		return int64(binary.BigEndian.Uint64(count)) + 1, nil
+	}
+	return 1, nil
+}
+
+// decodeCounter converts the stored values of a counter into a counter.
+func decodeCounter(name string, values map[string][]byte) *pb.Counter {
+	return &pb.Counter{
+		Name:    name,
+		Target:  int64(binary.BigEndian.Uint64(values["Counters:target"])),
+		Count:   int64(binary.BigEndian.Uint64(values["Counters:count"])),
+		Expires: timestamppb.New(time.Unix(0, int64(binary.BigEndian.Uint64(values["Counters:expires"])))),
+	}
+}
+
+// createCounter replaces the counter stored under counter.Name with a new counter
+// if the stored etag still matches tag. An empty tag only creates missing counters.
+func (b *Bigtable) createCounter(ctx context.Context, tag string, counter *pb.Counter) error {
+	var filter bigtable.Filter
+	if tag == "" {
+		filter = bigtable.FamilyFilter("Counters")
+	} else {
+		filter = bigtable.ChainFilters(
+			bigtable.FamilyFilter("Counters"),
+			bigtable.ColumnFilter("etag"),
+			bigtable.LatestNFilter(1),
+			bigtable.ValueFilter(tag),
+		)
+	}
+
+	ts, err := ptypes.Timestamp(counter.Expires)
+	if err != nil {
+		return err
+	}
+
+	mut := bigtable.NewMutation()
+	mut.DeleteCellsInFamily("Counters")
+	mut.Set("Counters", "etag", bigtable.Now(), []byte(uuid.New().String()))
+	mut.Set("Counters", "target", bigtable.Now(), encodeInt(counter.Target))
+	mut.Set("Counters", "count", bigtable.Now(), encodeInt(0))
+	mut.Set("Counters", "expires", bigtable.Now(), encodeInt(ts.UnixNano()))
+
+	// Losing a race to create the counter is fine, the winner's counter is used.
+	var condMut *bigtable.Mutation
+	if tag == "" {
+		condMut = bigtable.NewCondMutation(filter, nil, mut)
+	} else {
+		condMut = bigtable.NewCondMutation(filter, mut, nil)
+	}
+	return b.table.Apply(ctx, counter.Name, condMut)
+}
+
+// Count adds delta to the counter stored under counter.Name and returns its updated
+// state. A counter that does not exist or has expired is first created from counter.
+func (b *Bigtable) Count(ctx context.Context, counter *pb.Counter, delta int64) (*pb.Counter, error) {
+	values, err := b.readCounter(ctx, counter.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 || time.Now().After(decodeCounter(counter.Name, values).Expires.AsTime()) {
+		if err := b.createCounter(ctx, string(values["Counters:etag"]), counter); err != nil {
+			return nil, err
+		}
+	}
+
+	if delta != 0 {
+		rmw := bigtable.NewReadModifyWrite()
+		rmw.Increment("Counters", "count", delta)
+		if _, err := b.table.ApplyReadModifyWrite(ctx, counter.Name, rmw); err != nil {
+			return nil, err
+		}
+	}
+
+	if values, err = b.readCounter(ctx, counter.Name); err != nil {
+		return nil, err
+	}
+	return decodeCounter(counter.Name, values), nil
+}
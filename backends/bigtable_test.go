@@ -5,12 +5,11 @@ import (
 	"testing"
 
 	"cloud.google.com/go/bigtable/bttest"
-	pb "github.com/gcp-services/lock/storage"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
 )
 
-func setupBigtable() (pb.LockServiceServer, error) {
+func setupBigtable() (Backend, error) {
 	ctx := context.Background()
 	server, err := bttest.NewServer(":9011")
 	if err != nil {
@@ -0,0 +1,266 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	pb "github.com/gcp-services/lock/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DeadlockError is returned to a waiter whose wait would complete a cycle of owners
+// waiting on each other's locks. It matches ErrDeadlock, and carries the cycle as a
+// pb.Deadlock detail when returned over gRPC.
+type DeadlockError struct {
+	// Cycle starts with the wait of the failed waiter.
+	Cycle []*pb.WaitFor
+}
+
+func (e *DeadlockError) Error() string {
+	waits := make([]string, len(e.Cycle))
+	for i, w := range e.Cycle {
+		waits[i] = fmt.Sprintf("%s waits on %s held by %s", w.Owner, w.Uuid, w.Holder)
+	}
+	return fmt.Sprintf("%v: %s", ErrDeadlock, strings.Join(waits, ", "))
+}
+
+// Is reports whether target is ErrDeadlock.
+func (e *DeadlockError) Is(target error) bool {
+	return target == ErrDeadlock
+}
+
+// GRPCStatus converts the error into an aborted status with the cycle attached.
+func (e *DeadlockError) GRPCStatus() *status.Status {
+	st := status.New(codes.Aborted, e.Error())
+	if detailed, err := st.WithDetails(&pb.Deadlock{Cycle: e.Cycle}); err == nil {
+		return detailed
+	}
+	return st
+}
+
+// WaitGraph tracks the blocking Lock calls of a server. It records which owners are
+// waiting on locks held by other owners to detect calls that would wait on each
+// other forever, and orders the callers waiting on each lock by priority.
+type WaitGraph struct {
+	mu sync.Mutex
+	// waits maps a waiting owner to the holder of every lock it is waiting on, by
+	// the storage key of the lock.
+	waits map[participant]map[string]string
+	// queues holds the callers waiting on every lock, in the order they are served.
+	queues map[string][]*waiter
+	// closed is set once the graph no longer accepts waiters.
+	closed bool
+}
+
+// participant identifies an owner of the wait-for graph. Owners of different
+// namespaces are unrelated, even when they have the same name.
+type participant struct {
+	namespace string
+	owner     string
+}
+
+// splitKey splits the storage key of a lock into its namespace and uuid.
+func splitKey(key string) (namespace, uuid string) {
+	if !strings.HasPrefix(key, namespacePrefix) {
+		return "", key
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, namespacePrefix), "/", 2)
+	if len(parts) != 2 {
+		return "", key
+	}
+	return parts[0], parts[1]
+}
+
+// waitFor returns the wait of owner on the lock stored under key, as reported to
+// clients.
+func waitFor(owner, key, holder string) *pb.WaitFor {
+	namespace, uuid := splitKey(key)
+	return &pb.WaitFor{Owner: owner, Uuid: uuid, Holder: holder, Namespace: namespace}
+}
+
+// waiter is a blocking Lock call queued on a lock.
+type waiter struct {
+	priority int32
+}
+
+// NewWaitGraph creates an empty wait-for graph.
+func NewWaitGraph() *WaitGraph {
+	return &WaitGraph{
+		waits:  make(map[participant]map[string]string),
+		queues: make(map[string][]*waiter),
+	}
+}
+
+// enqueue queues w on the lock uuid, behind every waiter of the same or a higher
+// priority.
+func (g *WaitGraph) enqueue(uuid string, w *waiter) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	queue := g.queues[uuid]
+	i := 0
+	for i < len(queue) && queue[i].priority >= w.priority {
+		i++
+	}
+	queue = append(queue, nil)
+	copy(queue[i+1:], queue[i:])
+	queue[i] = w
+	g.queues[uuid] = queue
+}
+
+// dequeue removes w from the queue of the lock uuid.
+func (g *WaitGraph) dequeue(uuid string, w *waiter) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	queue := g.queues[uuid]
+	for i := range queue {
+		if queue[i] == w {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+
+	if len(queue) == 0 {
+		delete(g.queues, uuid)
+		return
+	}
+	g.queues[uuid] = queue
+}
+
+// first reports whether w is the next waiter to be served on the lock uuid.
+func (g *WaitGraph) first(uuid string, w *waiter) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	queue := g.queues[uuid]
+	return len(queue) > 0 && queue[0] == w
+}
+
+// wait records that owner is waiting on the lock stored under key, held by holder
+// in the namespace of the lock. A *DeadlockError is returned, and the wait is not
+// recorded, if holder is already waiting on owner.
+func (g *WaitGraph) wait(owner, key, holder string) error {
+	// Owners waiting on their own locks are released once the lock expires.
+	if owner == holder {
+		g.done(owner, key)
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	namespace, _ := splitKey(key)
+	from := participant{namespace: namespace, owner: owner}
+	to := participant{namespace: namespace, owner: holder}
+	if cycle := g.path(to, from, map[participant]bool{}); cycle != nil {
+		return &DeadlockError{Cycle: append([]*pb.WaitFor{waitFor(owner, key, holder)}, cycle...)}
+	}
+
+	if g.waits[from] == nil {
+		g.waits[from] = make(map[string]string)
+	}
+	g.waits[from][key] = holder
+	return nil
+}
+
+// path returns the waits leading from owner to target, or nil if there are none.
+// The caller must hold g.mu.
+func (g *WaitGraph) path(owner, target participant, visited map[participant]bool) []*pb.WaitFor {
+	visited[owner] = true
+	for key, holder := range g.waits[owner] {
+		edge := waitFor(owner.owner, key, holder)
+		next := participant{namespace: owner.namespace, owner: holder}
+		if next == target {
+			return []*pb.WaitFor{edge}
+		}
+		if visited[next] {
+			continue
+		}
+		if rest := g.path(next, target, visited); rest != nil {
+			return append([]*pb.WaitFor{edge}, rest...)
+		}
+	}
+	return nil
+}
+
+// done removes the wait of owner on the lock stored under key.
+func (g *WaitGraph) done(owner, key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	namespace, _ := splitKey(key)
+	from := participant{namespace: namespace, owner: owner}
+	delete(g.waits[from], key)
+	if len(g.waits[from]) == 0 {
+		delete(g.waits, from)
+	}
+}
+
+// Watch streams the changes of a lock from backend to its holder until it is lost.
+// Like waiting Lock calls, watches end with ErrShuttingDown once the graph is
+// closed.
+func (g *WaitGraph) Watch(backend Backend, in *pb.WatchRequest, stream pb.LockService_WatchServer) error {
+	if g.isClosed() {
+		return ErrShuttingDown
+	}
+	return doWatch(backend, in, stream, g.isClosed)
+}
+
+// Close fails every Lock call that is waiting on a lock, or made afterwards, with
+// ErrShuttingDown, and ends every watch. Waiting calls notice within the interval
+// between two attempts to acquire their lock.
+func (g *WaitGraph) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+}
+
+// isClosed reports whether Close has been called.
+func (g *WaitGraph) isClosed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closed
+}
+
+// Lock will attempt to acquire a lock from backend, blocking until a lock is
+// acquired or until the timeout is met. Only the waiter with the highest priority
+// attempts to acquire a lock, with waiters of the same priority served in the order
+// they arrived. While blocked, the wait is recorded in the graph, and the call fails
+// with a *DeadlockError if the owner of the lock is itself waiting on a lock held by
+// this caller.
+func (g *WaitGraph) Lock(ctx context.Context, backend Backend, in *pb.LockRequest) (*pb.LockResponse, error) {
+	if g.isClosed() {
+		return nil, ErrShuttingDown
+	}
+
+	w := &waiter{
+		priority: in.Priority,
+	}
+	g.enqueue(in.Lock.Uuid, w)
+	defer g.dequeue(in.Lock.Uuid, w)
+	defer g.done(in.Lock.Owner, in.Lock.Uuid)
+
+	ready := func() bool {
+		return g.first(in.Lock.Uuid, w)
+	}
+
+	return waitForLock(ctx, backend, in, ready, func() error {
+		if g.isClosed() {
+			return ErrShuttingDown
+		}
+
+		holder, err := backend.Read(ctx, in.Lock.Uuid)
+		switch {
+		case err == ErrLockNotFound:
+			g.done(in.Lock.Owner, in.Lock.Uuid)
+			return nil
+		case err != nil:
+			return err
+		}
+		return g.wait(in.Lock.Owner, in.Lock.Uuid, holder.Owner)
+	})
+}
@@ -0,0 +1,156 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestWaitGraph(t *testing.T) {
+	g := NewWaitGraph()
+
+	// a waits on b, and b waits on c.
+	if err := g.wait("a", "1", "b"); err != nil {
+		t.Fatalf("unexpected error waiting: %v", err)
+	}
+	if err := g.wait("b", "2", "c"); err != nil {
+		t.Fatalf("unexpected error waiting: %v", err)
+	}
+
+	// Owners waiting on their own locks are not deadlocked.
+	if err := g.wait("c", "3", "c"); err != nil {
+		t.Fatalf("unexpected error waiting: %v", err)
+	}
+
+	// c waiting on a completes the cycle.
+	err := g.wait("c", "3", "a")
+	if !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("expected deadlock, instead: %v", err)
+	}
+
+	// The cycle is exposed in the status details.
+	st := status.Convert(err)
+	if st.Code() != codes.Aborted {
+		t.Fatalf("expected aborted status, instead: %v", st.Code())
+	}
+	if len(st.Details()) != 1 {
+		t.Fatalf("expected a single status detail, instead: %v", st.Details())
+	}
+	deadlock, ok := st.Details()[0].(*pb.Deadlock)
+	if !ok {
+		t.Fatalf("expected deadlock detail, instead: %T", st.Details()[0])
+	}
+	var owners []string
+	for _, w := range deadlock.Cycle {
+		owners = append(owners, w.Owner)
+	}
+	if len(owners) != 3 || owners[0] != "c" || owners[1] != "a" || owners[2] != "b" {
+		t.Fatalf("unexpected cycle: %v", deadlock.Cycle)
+	}
+
+	// Once b stops waiting there is no cycle.
+	g.done("b", "2")
+	if err := g.wait("c", "3", "a"); err != nil {
+		t.Fatalf("unexpected error waiting: %v", err)
+	}
+}
+
+func TestWaitGraphNamespaces(t *testing.T) {
+	g := NewWaitGraph()
+
+	// Owners of different namespaces never wait on each other.
+	if err := g.wait("a", "ns/team-a/1", "b"); err != nil {
+		t.Fatalf("unexpected error waiting: %v", err)
+	}
+	if err := g.wait("b", "ns/team-b/2", "a"); err != nil {
+		t.Fatalf("unexpected error waiting: %v", err)
+	}
+	if err := g.wait("b", "2", "a"); err != nil {
+		t.Fatalf("unexpected error waiting: %v", err)
+	}
+
+	// The cycle reports the locks by their uuid in their namespace.
+	err := g.wait("b", "ns/team-a/2", "a")
+	var deadlock *DeadlockError
+	if !errors.As(err, &deadlock) {
+		t.Fatalf("expected deadlock, instead: %v", err)
+	}
+	if len(deadlock.Cycle) != 2 {
+		t.Fatalf("unexpected cycle: %v", deadlock.Cycle)
+	}
+	for _, w := range deadlock.Cycle {
+		if w.Namespace != "team-a" || strings.HasPrefix(w.Uuid, namespacePrefix) {
+			t.Fatalf("expected waits of namespace team-a, instead: %v", w)
+		}
+	}
+}
+
+func TestWaitGraphPriority(t *testing.T) {
+	g := NewWaitGraph()
+
+	low := &waiter{priority: 0}
+	high := &waiter{priority: 1}
+	later := &waiter{priority: 1}
+	g.enqueue("1", low)
+	g.enqueue("1", high)
+	g.enqueue("1", later)
+
+	// Higher priorities are served first, and equal priorities in arrival order.
+	for _, w := range []*waiter{high, later, low} {
+		if !g.first("1", w) {
+			t.Fatalf("expected waiter with priority %d to be served", w.priority)
+		}
+		g.dequeue("1", w)
+	}
+
+	if len(g.queues) != 0 {
+		t.Fatalf("expected no queued waiters, instead: %v", g.queues)
+	}
+}
+
+func testWaitGraphClose(t *testing.T, backend Backend) {
+	ctx := context.Background()
+	g := NewWaitGraph()
+	expires := timestamppb.New(time.Now().Add(time.Minute))
+
+	if _, err := backend.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{Uuid: "draining", Owner: "1234", Expires: expires},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := g.Lock(ctx, backend, &pb.LockRequest{
+			Lock:    &pb.Lock{Uuid: "draining", Owner: "5678", Expires: expires},
+			Timeout: durationpb.New(time.Minute),
+		})
+		errs <- err
+	}()
+
+	// Waiting calls fail with a retryable status once the graph is closed.
+	time.Sleep(time.Millisecond * 100)
+	g.Close()
+	select {
+	case err := <-errs:
+		if err != ErrShuttingDown || status.Code(err) != codes.Unavailable {
+			t.Fatalf("expected lock to fail with shutting down, instead: %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected waiting lock to fail once closed")
+	}
+
+	if _, err := g.Lock(ctx, backend, &pb.LockRequest{
+		Lock: &pb.Lock{Uuid: "draining", Owner: "5678", Expires: expires},
+	}); err != ErrShuttingDown {
+		t.Fatalf("expected lock to fail with shutting down, instead: %v", err)
+	}
+}
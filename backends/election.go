@@ -0,0 +1,204 @@
+package backends
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// electionPrefix keeps the locks backing elections apart from regular locks.
+const electionPrefix = "election/"
+
+// Election implements leader election on top of a lock backend. Every election is
+// stored as a single lock owned by the current leader, and the term the backend
+// gives that lock when it changes owner is used as the fencing term for the
+// leadership.
+type Election struct {
+	backend Backend
+
+	// closed is closed once blocked calls should be abandoned.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewElection creates a new election service that stores elections in backend.
+// Servers pass a backend acquiring locks through their lock service, created with
+// ServiceBackend, so that elections are bound by the same checks as other locks.
+func NewElection(backend Backend) *Election {
+	return &Election{
+		backend: backend,
+		closed:  make(chan struct{}),
+	}
+}
+
+// Close makes blocked Campaign calls and Observe streams fail with
+// ErrShuttingDown, so that their callers retry against another server.
+func (e *Election) Close() {
+	e.closeOnce.Do(func() { close(e.closed) })
+}
+
+// leader returns the current, unexpired leader of an election.
+func (e *Election) leader(ctx context.Context, name string) (*pb.Leader, error) {
+	lock, err := e.backend.Read(ctx, electionPrefix+name)
+	switch {
+	case err == ErrLockNotFound:
+		return nil, ErrNoLeader
+	case err != nil:
+		return nil, err
+	}
+
+	if lock.Term == 0 || time.Now().After(lock.Expires.AsTime()) {
+		return nil, ErrNoLeader
+	}
+
+	return &pb.Leader{
+		Name:      name,
+		Candidate: lock.Owner,
+		Term:      lock.Term,
+		Expires:   lock.Expires,
+	}, nil
+}
+
+// campaign makes a single attempt at becoming, or remaining, the leader of an
+// election. ErrLockBusy is returned if another candidate holds the leadership.
+func (e *Election) campaign(ctx context.Context, name, candidate string, ttl time.Duration) (*pb.Leader, error) {
+	ctx = internalContext(ctx)
+	lock := &pb.Lock{
+		Uuid:    electionPrefix + name,
+		Owner:   candidate,
+		Expires: timestamppb.New(time.Now().Add(ttl)),
+	}
+
+	// Renew the leadership if this candidate already holds it, which keeps the
+	// term unchanged. Otherwise try to take over the election.
+	_, err := e.backend.Refresh(ctx, &pb.RefreshRequest{
+		Lock: lock,
+	})
+
+	switch err {
+	case nil, ErrLockInvalidRefresh:
+		break
+	case ErrLockNotFound, ErrLockInvalidOwner:
+		if _, err := e.backend.TryLock(ctx, &pb.TryLockRequest{
+			Lock: lock,
+		}); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	leader, err := e.leader(ctx, name)
+	switch {
+	case err == ErrNoLeader:
+		return nil, ErrLockBusy
+	case err != nil:
+		return nil, err
+	case leader.Candidate != candidate:
+		return nil, ErrLockBusy
+	}
+	return leader, nil
+}
+
+// Campaign will attempt to become the leader of an election, blocking until
+// leadership is acquired or until the timeout is met. The current leader must
+// campaign again before its ttl elapses to keep the leadership.
+func (e *Election) Campaign(ctx context.Context, in *pb.CampaignRequest) (*pb.CampaignResponse, error) {
+	ttl, err := ptypes.Duration(in.Ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := optionalDuration(in.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	for {
+		leader, err := e.campaign(ctx, in.Name, in.Candidate, ttl)
+
+		switch err {
+		case ErrLockBusy:
+			break
+		case nil:
+			return &pb.CampaignResponse{Leader: leader}, nil
+		default:
+			return nil, err
+		}
+
+		// Check if the maximum wait duration has expired.
+		if time.Now().After(start.Add(timeout)) {
+			return nil, ErrLockBusy
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-e.closed:
+			return nil, ErrShuttingDown
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Resign gives up the leadership of an election held by the candidate.
+func (e *Election) Resign(ctx context.Context, in *pb.ResignRequest) (*pb.ResignResponse, error) {
+	if _, err := e.backend.Release(internalContext(ctx), &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:  electionPrefix + in.Name,
+			Owner: in.Candidate,
+		},
+	}); err != nil {
+		return nil, err
+	}
+	return &pb.ResignResponse{}, nil
+}
+
+// Leader returns the current leader of an election, or ErrNoLeader.
+func (e *Election) Leader(ctx context.Context, in *pb.LeaderRequest) (*pb.LeaderResponse, error) {
+	leader, err := e.leader(ctx, in.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.LeaderResponse{Leader: leader}, nil
+}
+
+// Observe streams the leader of an election every time the leadership changes.
+// A leader with an empty candidate and a zero term is sent while the election
+// has no leader.
+func (e *Election) Observe(in *pb.ObserveRequest, stream pb.ElectionService_ObserveServer) error {
+	ctx := stream.Context()
+
+	var last *pb.Leader
+	for {
+		leader, err := e.leader(ctx, in.Name)
+		switch err {
+		case ErrNoLeader:
+			leader = &pb.Leader{Name: in.Name}
+		case nil:
+			break
+		default:
+			return err
+		}
+
+		if last == nil || last.Candidate != leader.Candidate || last.Term != leader.Term {
+			if err := stream.Send(&pb.ObserveResponse{Leader: leader}); err != nil {
+				return err
+			}
+			last = leader
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-e.closed:
+			return ErrShuttingDown
+		case <-time.After(time.Second):
+		}
+	}
+}
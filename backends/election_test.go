@@ -0,0 +1,120 @@
+package backends
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func testElection(t *testing.T, backend Backend) {
+	ctx := context.Background()
+	election := NewElection(backend)
+
+	// An election nobody campaigned in has no leader.
+	if _, err := election.Leader(ctx, &pb.LeaderRequest{Name: "test"}); err != ErrNoLeader {
+		t.Fatalf("expected no leader, instead: %v", err)
+	}
+
+	// Become the leader.
+	first, err := election.Campaign(ctx, &pb.CampaignRequest{
+		Name:      "test",
+		Candidate: "a",
+		Ttl:       durationpb.New(time.Second * 30),
+	})
+	if err != nil {
+		t.Fatalf("error campaigning: %v", err)
+	}
+	if first.Leader.Candidate != "a" || first.Leader.Term == 0 {
+		t.Fatalf("unexpected leader: %v", first.Leader)
+	}
+
+	// Another candidate can not take over while the leadership is held.
+	if _, err := election.Campaign(ctx, &pb.CampaignRequest{
+		Name:      "test",
+		Candidate: "b",
+		Ttl:       durationpb.New(time.Second * 30),
+		Timeout:   durationpb.New(time.Millisecond * 100),
+	}); err != ErrLockBusy {
+		t.Fatalf("expected election to be busy, instead: %v", err)
+	}
+
+	// Campaigning again renews the leadership without changing the term.
+	renewed, err := election.Campaign(ctx, &pb.CampaignRequest{
+		Name:      "test",
+		Candidate: "a",
+		Ttl:       durationpb.New(time.Second * 60),
+	})
+	if err != nil {
+		t.Fatalf("error renewing leadership: %v", err)
+	}
+	if renewed.Leader.Term != first.Leader.Term {
+		t.Fatalf("expected term %d to be kept, instead: %d", first.Leader.Term, renewed.Leader.Term)
+	}
+
+	leader, err := election.Leader(ctx, &pb.LeaderRequest{Name: "test"})
+	if err != nil {
+		t.Fatalf("error reading leader: %v", err)
+	}
+	if leader.Leader.Candidate != "a" {
+		t.Fatalf("expected a to lead, instead: %v", leader.Leader)
+	}
+
+	// Only the leader can resign.
+	if _, err := election.Resign(ctx, &pb.ResignRequest{Name: "test", Candidate: "b"}); err != ErrLockInvalidOwner {
+		t.Fatalf("expected resign to fail with invalid owner, instead: %v", err)
+	}
+	if _, err := election.Resign(ctx, &pb.ResignRequest{Name: "test", Candidate: "a"}); err != nil {
+		t.Fatalf("error resigning: %v", err)
+	}
+	if _, err := election.Leader(ctx, &pb.LeaderRequest{Name: "test"}); err != ErrNoLeader {
+		t.Fatalf("expected no leader after resigning, instead: %v", err)
+	}
+
+	// A new leader is elected with the next term, counted in the backend rather
+	// than read from the clock of a server.
+	second, err := election.Campaign(ctx, &pb.CampaignRequest{
+		Name:      "test",
+		Candidate: "b",
+		Ttl:       durationpb.New(time.Second),
+	})
+	if err != nil {
+		t.Fatalf("error campaigning: %v", err)
+	}
+	if second.Leader.Term != first.Leader.Term+1 {
+		t.Fatalf("expected term %d after %d, instead: %d", first.Leader.Term+1, first.Leader.Term, second.Leader.Term)
+	}
+
+	// Terms keep increasing when a leadership expires.
+	time.Sleep(time.Second * 2)
+	third, err := election.Campaign(ctx, &pb.CampaignRequest{
+		Name:      "test",
+		Candidate: "c",
+		Ttl:       durationpb.New(time.Second * 30),
+	})
+	if err != nil {
+		t.Fatalf("error campaigning: %v", err)
+	}
+	if third.Leader.Term != second.Leader.Term+1 {
+		t.Fatalf("expected term %d after %d, instead: %d", second.Leader.Term+1, second.Leader.Term, third.Leader.Term)
+	}
+
+	// Closing the election ends blocked campaigns, so that a server can stop.
+	errs := make(chan error)
+	go func() {
+		_, err := election.Campaign(ctx, &pb.CampaignRequest{
+			Name:      "test",
+			Candidate: "d",
+			Ttl:       durationpb.New(time.Second * 30),
+			Timeout:   durationpb.New(time.Minute),
+		})
+		errs <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+	election.Close()
+	if err := <-errs; err != ErrShuttingDown {
+		t.Fatalf("expected campaign to fail with shutting down, instead: %v", err)
+	}
+}
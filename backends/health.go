@@ -0,0 +1,76 @@
+package backends
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// probeUuid is the lock read to check that a backend can be reached. It doesn't
+// need to exist.
+const probeUuid = "health/probe"
+
+// Health reports the services of a server as serving only while their backend can
+// be reached, by probing the backend periodically.
+type Health struct {
+	backend  Backend
+	server   *health.Server
+	interval time.Duration
+}
+
+// NewHealth creates a health checker that probes backend every interval, and
+// reports the result for every service of the lock server through server.
+func NewHealth(backend Backend, server *health.Server, interval time.Duration) *Health {
+	return &Health{
+		backend:  backend,
+		server:   server,
+		interval: interval,
+	}
+}
+
+// probe checks that the backend can be reached, within one interval.
+func (h *Health) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.interval)
+	defer cancel()
+
+	_, err := h.backend.Read(ctx, probeUuid)
+	if err == ErrLockNotFound {
+		return nil
+	}
+	return err
+}
+
+// check probes the backend once and updates the serving status of the server.
+func (h *Health) check(ctx context.Context) {
+	status := healthpb.HealthCheckResponse_SERVING
+	if err := h.probe(ctx); err != nil {
+		zap.L().Warn("backend health probe failed", zap.Error(err))
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	h.server.SetServingStatus("", status)
+	services := pb.File_storage_lock_proto.Services()
+	for i := 0; i < services.Len(); i++ {
+		h.server.SetServingStatus(string(services.Get(i).FullName()), status)
+	}
+}
+
+// Run probes the backend every interval until ctx is done.
+func (h *Health) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// unreachableBackend is a backend that can't be reached.
+type unreachableBackend struct {
+	Backend
+}
+
+func (unreachableBackend) Read(ctx context.Context, uuid string) (*pb.Lock, error) {
+	return nil, fmt.Errorf("backend unreachable")
+}
+
+func testHealth(t *testing.T, backend Backend) {
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		backend Backend
+		status  healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{backend, healthpb.HealthCheckResponse_SERVING},
+		{unreachableBackend{backend}, healthpb.HealthCheckResponse_NOT_SERVING},
+	} {
+		server := health.NewServer()
+		NewHealth(c.backend, server, time.Second).check(ctx)
+
+		for _, service := range []string{"", "storage.LockService", "storage.ElectionService", "storage.BarrierService"} {
+			resp, err := server.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+			if err != nil {
+				t.Fatalf("error checking health of %q: %v", service, err)
+			}
+			if resp.Status != c.status {
+				t.Fatalf("expected %q to be %v, instead: %v", service, c.status, resp.Status)
+			}
+		}
+	}
+}
@@ -2,28 +2,340 @@ package backends
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	pb "github.com/gcp-services/lock/storage"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/label"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+const (
+	// maxPayloadSize is the largest payload, or value, that can be stored with a lock.
+	maxPayloadSize = 4096
+	// defaultPageSize is the number of locks listed when no page size is requested.
+	defaultPageSize = 100
+	// maxPageSize is the largest number of locks listed at once.
+	maxPageSize = 1000
+	// maxLockDelay is the longest lock-delay a lock can be acquired with.
+	maxLockDelay = time.Minute
+	// requestTTL is how long the response of an applied request is kept for its
+	// retries.
+	requestTTL = 10 * time.Minute
+	// requestPurgeInterval is how often backends that don't expire requests by
+	// themselves delete the expired ones.
+	requestPurgeInterval = time.Minute
+)
+
+// Backend is a lock service backed by a durable store. In addition to the lock
+// service RPCs, backends can report the current state of a lock and maintain the
+// counters used by barriers and latches.
+type Backend interface {
+	pb.LockServiceServer
+
+	// Read returns the lock currently stored under uuid, whether or not it has
+	// expired. ErrLockNotFound is returned if no such lock exists.
+	Read(ctx context.Context, uuid string) (*pb.Lock, error)
+
+	// Count atomically adds delta to the counter stored under counter.Name and
+	// returns its updated state. Counters that do not exist or have expired are
+	// first created from counter with a count of zero.
+	Count(ctx context.Context, counter *pb.Counter, delta int64) (*pb.Counter, error)
+
+	// Close releases the connections of the backend. It must not be used
+	// afterwards.
+	Close() error
+}
+
+// ServiceBackend returns a backend passing lock requests to service, and reads
+// and counters to backend. Services built on locks, such as elections, use it to
+// acquire their locks through the lock service of the server, so that they are
+// bound by its namespaces, quotas and owner binding like any other lock.
+func ServiceBackend(service pb.LockServiceServer, backend Backend) Backend {
+	return &serviceBackend{LockServiceServer: service, backend: backend}
+}
+
+// serviceBackend passes lock requests to a lock service.
+type serviceBackend struct {
+	pb.LockServiceServer
+	backend Backend
+}
+
+func (b *serviceBackend) Read(ctx context.Context, uuid string) (*pb.Lock, error) {
+	return b.backend.Read(ctx, uuid)
+}
+
+func (b *serviceBackend) Count(ctx context.Context, counter *pb.Counter, delta int64) (*pb.Counter, error) {
+	return b.backend.Count(ctx, counter, delta)
+}
+
+func (b *serviceBackend) Close() error {
+	return b.backend.Close()
+}
+
+// detachedContext carries the values of a context without its cancellation and
+// deadline.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// withoutCancel returns a context with the values of ctx that is never cancelled,
+// like context.WithoutCancel, for the writes that must complete even once the
+// request that made them is gone.
+func withoutCancel(ctx context.Context) context.Context {
+	return detachedContext{Context: ctx}
+}
+
+// optionalDuration converts an optional request duration, such as a timeout, into
+// a duration. A missing duration is treated as zero.
+func optionalDuration(in *duration.Duration) (time.Duration, error) {
+	if in == nil {
+		return 0, nil
+	}
+	return ptypes.Duration(in)
+}
+
+// validateLock checks a lock requested by a caller before it is stored.
+func validateLock(lock *pb.Lock) error {
+	if len(lock.GetPayload()) > maxPayloadSize || len(lock.GetValue()) > maxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+	if lock.GetLockDelay().AsDuration() > maxLockDelay {
+		return ErrLockDelayTooLong
+	}
+	return nil
+}
+
+// pageSize returns the number of locks to list for a request.
+func pageSize(in *pb.ListRequest) int {
+	switch {
+	case in.PageSize <= 0:
+		return defaultPageSize
+	case in.PageSize > maxPageSize:
+		return maxPageSize
+	}
+	return int(in.PageSize)
+}
+
+// requestKey returns the key recording the response of a request to method, or an
+// empty key if the request is not identified by a request id. Request ids are
+// scoped to the lock and owner of a request.
+func requestKey(method string, lock *pb.Lock, id string) string {
+	if id == "" {
+		return ""
+	}
+	return strings.Join([]string{"request", method, lock.GetUuid(), lock.GetOwner(), id}, "/")
+}
+
+// newLock returns the lock stored when in acquires a lock that is free.
+func newLock(in *pb.TryLockRequest) *pb.Lock {
+	lock := &pb.Lock{
+		Uuid:        in.Lock.Uuid,
+		Owner:       in.Lock.Owner,
+		Expires:     in.Lock.Expires,
+		Acquired:    timestamppb.Now(),
+		Holds:       1,
+		Priority:    in.Priority,
+		Preemptible: in.Lock.Preemptible,
+		Labels:      in.Lock.Labels,
+		Payload:     in.Lock.Payload,
+		LockDelay:   in.Lock.LockDelay,
+	}
+	if in.IssueToken {
+		lock.Token = uuid.New().String()
+	}
+	return lock
+}
+
+// fenced reports whether the lock stored under uuid is given a fencing term, which
+// is incremented every time the lock is taken by a new owner. Only the locks backing
+// elections are, whose terms are the terms of their leaders.
+func fenced(uuid string) bool {
+	return strings.HasPrefix(uuid, electionPrefix)
+}
+
+// storedLock returns a copy of a stored lock that can be changed and written back.
+// Locks stored before the acquisition time was recorded are treated as acquired now.
+func storedLock(stored *pb.Lock) *pb.Lock {
+	lock := proto.Clone(stored).(*pb.Lock)
+	if lock.Acquired == nil {
+		lock.Acquired = timestamppb.Now()
+	}
+	return lock
+}
+
+// reentrantLock returns the lock stored when its owner acquires a reentrant lock
+// again. The expiry of the stored lock is kept if it is later than requested.
+func reentrantLock(in *pb.TryLockRequest, stored *pb.Lock) *pb.Lock {
+	lock := storedLock(stored)
+	lock.Holds++
+	if in.Lock.Expires.AsTime().After(lock.Expires.AsTime()) {
+		lock.Expires = in.Lock.Expires
+	}
+	return lock
+}
+
+// refreshLock returns the lock stored when its owner refreshes it.
+func refreshLock(in *pb.RefreshRequest, stored *pb.Lock) *pb.Lock {
+	lock := storedLock(stored)
+	lock.Expires = in.Lock.Expires
+	return lock
+}
+
+// transferLock returns the lock stored when a lock is handed to its new owner. The
+// new owner is issued a token of its own if the stored lock has one.
+func transferLock(in *pb.TransferRequest, stored *pb.Lock) *pb.Lock {
+	return newLock(&pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      in.Lock.Uuid,
+			Owner:     in.NewOwner,
+			Expires:   in.Expires,
+			LockDelay: stored.LockDelay,
+		},
+		IssueToken: stored.Token != "",
+	})
+}
+
+// owns reports whether the owner of lock, and its token if one was issued, match
+// those of a stored lock.
+func owns(lock, stored *pb.Lock) bool {
+	return lock.Owner == stored.Owner && lock.Token == stored.Token
+}
+
+// checkEtag returns ErrLockEtagMismatch if the etag expected by lock, if any,
+// doesn't match the etag of the stored lock. A nil stored lock matches no etag.
+func checkEtag(lock, stored *pb.Lock) error {
+	if lock.GetEtag() != "" && lock.GetEtag() != stored.GetEtag() {
+		return ErrLockEtagMismatch
+	}
+	return nil
+}
+
+// redactLock removes the token from a lock returned to callers that don't own it,
+// along with its value, which is only read with Get.
+func redactLock(lock *pb.Lock) *pb.Lock {
+	lock.Token = ""
+	lock.Value = nil
+	return lock
+}
+
+// delayed reports whether an expired lock is still within its lock-delay, during
+// which only its owner can acquire it again.
+func delayed(in *pb.TryLockRequest, stored *pb.Lock) bool {
+	if stored.LockDelay == nil || owns(in.Lock, stored) {
+		return false
+	}
+	return time.Now().Before(stored.Expires.AsTime().Add(stored.LockDelay.AsDuration()))
+}
+
+// preempts reports whether in may revoke a stored lock from its owner.
+func preempts(in *pb.TryLockRequest, stored *pb.Lock) bool {
+	return stored.Preemptible && in.Priority > stored.Priority
+}
+
+// doDescribe is a generic function for describing a lock, shared by all backends.
+func doDescribe(ctx context.Context, backend Backend, in *pb.DescribeRequest) (*pb.DescribeResponse, error) {
+	lock, err := backend.Read(ctx, in.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DescribeResponse{Lock: redactLock(lock)}, nil
+}
+
+// doGet is a generic function for reading the value stored under a lock, shared by
+// all backends. Values disappear along with the lease of their lock.
+func doGet(ctx context.Context, backend Backend, in *pb.GetRequest) (*pb.GetResponse, error) {
+	lock, err := backend.Read(ctx, in.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(lock.Expires.AsTime()) {
+		return nil, ErrLockNotFound
+	}
+
+	return &pb.GetResponse{
+		Value:   lock.Value,
+		Owner:   lock.Owner,
+		Expires: lock.Expires,
+		Etag:    lock.Etag,
+	}, nil
+}
+
+// putLock returns the lock stored when its owner puts a value under it.
+func putLock(in *pb.PutRequest, stored *pb.Lock) *pb.Lock {
+	lock := storedLock(stored)
+	lock.Value = in.Value
+	return lock
+}
+
+// attemptKey is the context key of the function preparing every attempt of a
+// blocking Lock call.
+type attemptKey struct{}
+
+// withAttempt returns a context in which every attempt of a blocking Lock call to
+// acquire its lock is first passed to prepare, which may change the request or
+// abort the call by returning an error. Wrappers use it to apply limits that
+// depend on the time the lock is actually acquired.
+func withAttempt(ctx context.Context, prepare func(*pb.TryLockRequest) error) context.Context {
+	return context.WithValue(ctx, attemptKey{}, prepare)
+}
+
 // doLock is a generic function for awaiting a lock. All backends should call this
 // function in place of implementing Lock internally.
 func doLock(ctx context.Context, svc pb.LockServiceServer, in *pb.LockRequest) (*pb.LockResponse, error) {
+	return waitForLock(ctx, svc, in, nil, nil)
+}
+
+// waitForLock blocks until a lock is acquired or until the timeout is met. If set,
+// ready is called before every attempt to acquire the lock and may skip the attempt
+// by returning false, and onBusy is called every time the lock is found to be busy
+// and may abort the wait by returning an error.
+func waitForLock(ctx context.Context, svc pb.LockServiceServer, in *pb.LockRequest, ready func() bool, onBusy func() error) (*pb.LockResponse, error) {
 	start := time.Now()
 	req := &pb.TryLockRequest{
-		Lock: in.Lock,
+		Lock:       in.Lock,
+		Reentrant:  in.Reentrant,
+		Priority:   in.Priority,
+		RequestId:  in.RequestId,
+		IssueToken: in.IssueToken,
 	}
 
-	_, err := svc.TryLock(ctx, req)
+	// Every attempt is traced, including those skipped while other waiters are
+	// served first.
+	attempt := 0
+	tryLock := func() (resp *pb.TryLockResponse, err error) {
+		attempt++
+		ctx, span := startSpan(ctx, "TryLock attempt", in.Lock, label.Int("lock.attempt", attempt))
+		defer func() { endSpan(ctx, span, err, outcomeAcquired) }()
+
+		if ready != nil && !ready() {
+			span.SetAttributes(label.Bool("lock.queued", true))
+			return nil, ErrLockBusy
+		}
+		if prepare, ok := ctx.Value(attemptKey{}).(func(*pb.TryLockRequest) error); ok {
+			if err := prepare(req); err != nil {
+				return nil, err
+			}
+		}
+		return svc.TryLock(ctx, req)
+	}
+
+	resp, err := tryLock()
 
 	switch err {
 	case ErrLockBusy:
 		break
 	case nil:
-		// TODO(lobato): craft a response here.
-		return &pb.LockResponse{}, nil
+		return &pb.LockResponse{Holds: resp.Holds, Token: resp.Token, Etag: resp.Etag}, nil
 	}
 
 	dur, err := ptypes.Duration(in.Timeout)
@@ -37,17 +349,90 @@ func doLock(ctx context.Context, svc pb.LockServiceServer, in *pb.LockRequest) (
 			return nil, ErrLockBusy
 		}
 
-		_, err := svc.TryLock(ctx, req)
+		resp, err := tryLock()
 
 		switch err {
 		case ErrLockBusy:
 			break
 		case nil:
-			return &pb.LockResponse{}, nil
+			return &pb.LockResponse{Holds: resp.Holds, Token: resp.Token, Etag: resp.Etag}, nil
 		default:
 			return nil, err
 		}
 
-		time.Sleep(time.Second)
+		if onBusy != nil {
+			if err := onBusy(); err != nil {
+				return nil, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// doWatch is a generic function for streaming the changes of a lock to its holder,
+// shared by all backends. The lock is polled every second until it is lost, or
+// until closed, if set, returns true. A lock released and acquired by another owner
+// between two polls is reported as revoked.
+func doWatch(backend Backend, in *pb.WatchRequest, stream pb.LockService_WatchServer, closed func() bool) error {
+	ctx := stream.Context()
+
+	lock, err := backend.Read(ctx, in.Lock.GetUuid())
+	if err != nil {
+		return err
+	}
+	if !owns(in.Lock, lock) {
+		return ErrLockInvalidOwner
+	}
+	if time.Now().After(lock.Expires.AsTime()) {
+		return ErrLockExpired
+	}
+
+	last := lock
+	if err := stream.Send(&pb.WatchEvent{Type: pb.WatchEvent_HELD, Lock: redactLock(lock)}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		if closed != nil && closed() {
+			return ErrShuttingDown
+		}
+
+		lock, err := backend.Read(ctx, in.Lock.GetUuid())
+		switch {
+		case err == ErrLockNotFound:
+			return stream.Send(&pb.WatchEvent{Type: pb.WatchEvent_RELEASED})
+		case err != nil:
+			return err
+		}
+
+		var event pb.WatchEvent_Type
+		switch {
+		case !owns(in.Lock, lock) && time.Now().Before(last.Expires.AsTime()):
+			event = pb.WatchEvent_REVOKED
+		case !owns(in.Lock, lock) || time.Now().After(lock.Expires.AsTime()):
+			event = pb.WatchEvent_EXPIRED
+		case lock.Etag != last.Etag:
+			event = pb.WatchEvent_HELD
+		default:
+			continue
+		}
+
+		if err := stream.Send(&pb.WatchEvent{Type: event, Lock: redactLock(lock)}); err != nil {
+			return err
+		}
+		if event != pb.WatchEvent_HELD {
+			return nil
+		}
+		last = lock
 	}
 }
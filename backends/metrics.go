@@ -0,0 +1,268 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of the requests counted by Metrics.
+const (
+	outcomeAcquired     = "acquired"
+	outcomeOK           = "ok"
+	outcomeBusy         = "busy"
+	outcomeInvalidOwner = "invalid_owner"
+	outcomeNotFound     = "not_found"
+	outcomeError        = "error"
+)
+
+// Metrics records the requests served by a lock service, and the calls it makes
+// to its backend, with Prometheus.
+type Metrics struct {
+	requests *prometheus.CounterVec
+	waits    *prometheus.HistogramVec
+	waiting  prometheus.Gauge
+	latency  *prometheus.HistogramVec
+	held     prometheus.GaugeFunc
+
+	mu sync.Mutex
+	// leases maps the uuid of every lock acquired through an instrumented backend
+	// to its expiry.
+	leases map[string]time.Time
+}
+
+// NewMetrics creates the metrics of a lock service and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lock_requests_total",
+			Help: "Requests to acquire, refresh and release locks, by method and outcome.",
+		}, []string{"method", "outcome"}),
+		waits: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lock_wait_seconds",
+			Help:    "Time blocking Lock calls waited for their lock, by outcome.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"outcome"}),
+		waiting: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "lock_waiting",
+			Help: "Blocking Lock calls currently waiting for their lock.",
+		}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lock_backend_latency_seconds",
+			Help:    "Latency of the calls made to the backend, by backend and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"backend", "method"}),
+		leases: make(map[string]time.Time),
+	}
+	m.held = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "lock_held",
+		Help: "Unexpired locks acquired through this server and not yet released.",
+	}, m.countHeld)
+
+	for _, c := range []prometheus.Collector{m.requests, m.waits, m.waiting, m.latency, m.held} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// outcome classifies the error of a request. Successful requests have the outcome
+// success.
+func outcome(err error, success string) string {
+	switch {
+	case err == nil:
+		return success
+	case errors.Is(err, ErrLockBusy):
+		return outcomeBusy
+	case errors.Is(err, ErrLockInvalidOwner):
+		return outcomeInvalidOwner
+	case errors.Is(err, ErrLockNotFound):
+		return outcomeNotFound
+	default:
+		return outcomeError
+	}
+}
+
+// countHeld returns the number of unexpired locks acquired through an instrumented
+// backend, forgetting the locks that have expired.
+func (m *Metrics) countHeld() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for uuid, expires := range m.leases {
+		if !now.Before(expires) {
+			delete(m.leases, uuid)
+		}
+	}
+	return float64(len(m.leases))
+}
+
+// hold records that the lock uuid is held until it expires.
+func (m *Metrics) hold(uuid string, expires time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leases[uuid] = expires
+}
+
+// release records that the lock uuid is no longer held.
+func (m *Metrics) release(uuid string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.leases, uuid)
+}
+
+// Service returns a lock service counting the outcome of the requests served by
+// next, and timing its blocking Lock calls.
+func (m *Metrics) Service(next pb.LockServiceServer) pb.LockServiceServer {
+	return &meteredService{LockServiceServer: next, metrics: m}
+}
+
+// meteredService counts the requests of a lock service. Methods that are not
+// counted are passed through.
+type meteredService struct {
+	pb.LockServiceServer
+	metrics *Metrics
+}
+
+func (s *meteredService) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	resp, err := s.LockServiceServer.TryLock(ctx, in)
+	s.metrics.requests.WithLabelValues("TryLock", outcome(err, outcomeAcquired)).Inc()
+	return resp, err
+}
+
+func (s *meteredService) Lock(ctx context.Context, in *pb.LockRequest) (*pb.LockResponse, error) {
+	s.metrics.waiting.Inc()
+	start := time.Now()
+	resp, err := s.LockServiceServer.Lock(ctx, in)
+	s.metrics.waiting.Dec()
+
+	o := outcome(err, outcomeAcquired)
+	s.metrics.waits.WithLabelValues(o).Observe(time.Since(start).Seconds())
+	s.metrics.requests.WithLabelValues("Lock", o).Inc()
+	return resp, err
+}
+
+func (s *meteredService) Refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	resp, err := s.LockServiceServer.Refresh(ctx, in)
+	s.metrics.requests.WithLabelValues("Refresh", outcome(err, outcomeOK)).Inc()
+	return resp, err
+}
+
+func (s *meteredService) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	resp, err := s.LockServiceServer.Release(ctx, in)
+	s.metrics.requests.WithLabelValues("Release", outcome(err, outcomeOK)).Inc()
+	return resp, err
+}
+
+// Backend returns a backend timing every call made to next, which is labelled
+// with name, and tracking the locks held in it.
+func (m *Metrics) Backend(name string, next Backend) Backend {
+	return &meteredBackend{next: next, name: name, metrics: m}
+}
+
+// meteredBackend times the calls made to a backend.
+type meteredBackend struct {
+	next    Backend
+	name    string
+	metrics *Metrics
+}
+
+// observe records the latency of a call to method that started at start.
+func (b *meteredBackend) observe(method string, start time.Time) {
+	b.metrics.latency.WithLabelValues(b.name, method).Observe(time.Since(start).Seconds())
+}
+
+func (b *meteredBackend) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	defer b.observe("TryLock", time.Now())
+	resp, err := b.next.TryLock(ctx, in)
+	if err == nil {
+		b.metrics.hold(in.Lock.Uuid, in.Lock.Expires.AsTime())
+	}
+	return resp, err
+}
+
+func (b *meteredBackend) Lock(ctx context.Context, in *pb.LockRequest) (*pb.LockResponse, error) {
+	defer b.observe("Lock", time.Now())
+	resp, err := b.next.Lock(ctx, in)
+	if err == nil {
+		b.metrics.hold(in.Lock.Uuid, in.Lock.Expires.AsTime())
+	}
+	return resp, err
+}
+
+func (b *meteredBackend) Refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	defer b.observe("Refresh", time.Now())
+	resp, err := b.next.Refresh(ctx, in)
+	if err == nil {
+		b.metrics.hold(in.Lock.Uuid, in.Lock.Expires.AsTime())
+	}
+	return resp, err
+}
+
+func (b *meteredBackend) Transfer(ctx context.Context, in *pb.TransferRequest) (*pb.TransferResponse, error) {
+	defer b.observe("Transfer", time.Now())
+	resp, err := b.next.Transfer(ctx, in)
+	if err == nil {
+		b.metrics.hold(in.Lock.Uuid, in.Expires.AsTime())
+	}
+	return resp, err
+}
+
+func (b *meteredBackend) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	defer b.observe("Release", time.Now())
+	resp, err := b.next.Release(ctx, in)
+	if err == nil && resp.Holds == 0 {
+		b.metrics.release(in.Lock.Uuid)
+	}
+	return resp, err
+}
+
+func (b *meteredBackend) Describe(ctx context.Context, in *pb.DescribeRequest) (*pb.DescribeResponse, error) {
+	defer b.observe("Describe", time.Now())
+	return b.next.Describe(ctx, in)
+}
+
+func (b *meteredBackend) List(ctx context.Context, in *pb.ListRequest) (*pb.ListResponse, error) {
+	defer b.observe("List", time.Now())
+	return b.next.List(ctx, in)
+}
+
+func (b *meteredBackend) Put(ctx context.Context, in *pb.PutRequest) (*pb.PutResponse, error) {
+	defer b.observe("Put", time.Now())
+	return b.next.Put(ctx, in)
+}
+
+func (b *meteredBackend) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	defer b.observe("Get", time.Now())
+	return b.next.Get(ctx, in)
+}
+
+func (b *meteredBackend) History(ctx context.Context, in *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	defer b.observe("History", time.Now())
+	return b.next.History(ctx, in)
+}
+
+// Watch polls the lock through the metered backend, so that every read is observed.
+func (b *meteredBackend) Watch(in *pb.WatchRequest, stream pb.LockService_WatchServer) error {
+	return doWatch(b, in, stream, nil)
+}
+
+func (b *meteredBackend) Read(ctx context.Context, uuid string) (*pb.Lock, error) {
+	defer b.observe("Read", time.Now())
+	return b.next.Read(ctx, uuid)
+}
+
+func (b *meteredBackend) Count(ctx context.Context, counter *pb.Counter, delta int64) (*pb.Counter, error) {
+	defer b.observe("Count", time.Now())
+	return b.next.Count(ctx, counter, delta)
+}
+
+func (b *meteredBackend) Close() error {
+	return b.next.Close()
+}
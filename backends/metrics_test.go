@@ -0,0 +1,81 @@
+package backends
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func testMetrics(t *testing.T, backend Backend) {
+	ctx := context.Background()
+	metrics, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("error creating metrics: %v", err)
+	}
+	db := metrics.Backend("test", backend)
+	svc := metrics.Service(db)
+	expires := timestamppb.New(time.Now().Add(time.Minute))
+
+	if _, err := svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{Uuid: "metered", Owner: "1234", Expires: expires},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+	if _, err := svc.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{Uuid: "metered", Owner: "5678", Expires: expires},
+	}); err != ErrLockBusy {
+		t.Fatalf("expected lock to fail with busy, instead: %v", err)
+	}
+	if _, err := svc.Lock(ctx, &pb.LockRequest{
+		Lock:    &pb.Lock{Uuid: "metered", Owner: "5678", Expires: expires},
+		Timeout: durationpb.New(time.Millisecond * 100),
+	}); err != ErrLockBusy {
+		t.Fatalf("expected lock to fail with busy, instead: %v", err)
+	}
+
+	if held := testutil.ToFloat64(metrics.held); held != 1 {
+		t.Fatalf("expected one lock to be held, instead: %v", held)
+	}
+
+	if _, err := svc.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{Uuid: "metered", Owner: "1234"},
+	}); err != nil {
+		t.Fatalf("error releasing lock: %v", err)
+	}
+	if _, err := svc.Refresh(ctx, &pb.RefreshRequest{
+		Lock: &pb.Lock{Uuid: "metered", Owner: "1234", Expires: expires},
+	}); err != ErrLockNotFound {
+		t.Fatalf("expected refresh to fail with not found, instead: %v", err)
+	}
+
+	for _, c := range []struct {
+		method, outcome string
+		count           float64
+	}{
+		{"TryLock", outcomeAcquired, 1},
+		{"TryLock", outcomeBusy, 1},
+		{"Lock", outcomeBusy, 1},
+		{"Release", outcomeOK, 1},
+		{"Refresh", outcomeNotFound, 1},
+	} {
+		if count := testutil.ToFloat64(metrics.requests.WithLabelValues(c.method, c.outcome)); count != c.count {
+			t.Fatalf("expected %v %s requests with outcome %s, instead: %v", c.count, c.method, c.outcome, count)
+		}
+	}
+
+	if held := testutil.ToFloat64(metrics.held); held != 0 {
+		t.Fatalf("expected no locks to be held, instead: %v", held)
+	}
+	if waiting := testutil.ToFloat64(metrics.waiting); waiting != 0 {
+		t.Fatalf("expected no calls to be waiting, instead: %v", waiting)
+	}
+	if count := testutil.CollectAndCount(metrics.latency); count == 0 {
+		t.Fatalf("expected backend latency to be observed")
+	}
+}
@@ -0,0 +1,546 @@
+package backends
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// namespacePrefix keeps the locks of named namespaces apart from the locks of the
+// default namespace.
+const namespacePrefix = "ns/"
+
+// maxCapacityScan is the most locks of a namespace scanned to count the locks it
+// holds.
+const maxCapacityScan = 10 * maxPageSize
+
+// validNamespace matches the names of namespaces. Names can't contain the "/"
+// separating a namespace from its uuids, so no two namespaces share a key.
+var validNamespace = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// NamespaceConfig configures the locks held in a namespace.
+type NamespaceConfig struct {
+	// DefaultTTL is the time to live of locks requested without an expiry.
+	DefaultTTL time.Duration `mapstructure:"default_ttl"`
+
+	// MaxTTL, if set, is the longest time to live a lock can be requested with.
+	MaxTTL time.Duration `mapstructure:"max_ttl"`
+
+	// MaxHold, if set, is the longest a lock can be held from the time it was
+	// acquired, however often it is refreshed.
+	MaxHold time.Duration `mapstructure:"max_hold"`
+
+	// MaxLocks, if set, is the largest number of unexpired locks held at once,
+	// as counted in the backend.
+	MaxLocks int `mapstructure:"max_locks"`
+
+	// Quota limits the locks held and acquired in the namespace without
+	// consulting the backend.
+	Quota QuotaConfig `mapstructure:"quota"`
+}
+
+// Namespaces isolates the locks of every namespace in the keyspace of a shared lock
+// service, and enforces the configuration of each namespace. Locks of a named
+// namespace are stored under "ns/<namespace>/<uuid>", while locks of the default
+// namespace are stored under their uuid alone and can't use the "ns/" prefix, nor
+// the prefixes of the locks backing elections, barriers and latches.
+type Namespaces struct {
+	next    pb.LockServiceServer
+	configs map[string]*NamespaceConfig
+	quotas  *quotas
+}
+
+// NewNamespaces creates a new lock service that stores the locks of every
+// namespace in next. The default namespace is configured under the empty name, and
+// namespaces missing from configs are not restricted.
+func NewNamespaces(next pb.LockServiceServer, configs map[string]*NamespaceConfig) *Namespaces {
+	return &Namespaces{
+		next:    next,
+		configs: configs,
+		quotas:  newQuotas(),
+	}
+}
+
+// namespaceKey returns the prefix of the keys storing the locks of a namespace.
+func namespaceKey(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	return namespacePrefix + namespace + "/"
+}
+
+// reservedPrefixes are the uuid prefixes of the default namespace kept for the
+// locks of named namespaces, and for the locks and counters backing elections,
+// barriers and latches.
+var reservedPrefixes = []string{namespacePrefix, electionPrefix, barrierPrefix, latchPrefix}
+
+// reservedUuid reports whether a uuid of the default namespace uses a reserved
+// prefix.
+func reservedUuid(uuid string) bool {
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(uuid, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// internalKey marks the context of the requests made by the services built on
+// the lock service.
+type internalKey struct{}
+
+// internalContext returns a copy of ctx for the requests of a service built on the
+// lock service, which may use the uuids reserved for it.
+func internalContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalKey{}, true)
+}
+
+// storageKey returns the key a lock of a namespace is stored under. Reserved
+// uuids of the default namespace are only available to the requests of the
+// services built on the lock service, and the locks of named namespaces to none.
+func storageKey(ctx context.Context, namespace, uuid string) (string, error) {
+	if namespace == "" {
+		internal, _ := ctx.Value(internalKey{}).(bool)
+		if strings.HasPrefix(uuid, namespacePrefix) || (reservedUuid(uuid) && !internal) {
+			return "", ErrLockReservedUuid
+		}
+		return uuid, nil
+	}
+
+	if !validNamespace.MatchString(namespace) {
+		return "", ErrInvalidNamespace
+	}
+	return namespaceKey(namespace) + uuid, nil
+}
+
+// config returns the configuration of a namespace.
+func (n *Namespaces) config(namespace string) *NamespaceConfig {
+	if config, ok := n.configs[namespace]; ok {
+		return config
+	}
+	return &NamespaceConfig{}
+}
+
+// expires applies the configuration of a namespace to a requested expiry.
+func (n *Namespaces) expires(namespace string, expires *timestamppb.Timestamp) (*timestamppb.Timestamp, error) {
+	config := n.config(namespace)
+	if expires == nil && config.DefaultTTL > 0 {
+		return timestamppb.New(time.Now().Add(config.DefaultTTL)), nil
+	}
+
+	if config.MaxTTL > 0 && expires.AsTime().After(time.Now().Add(config.MaxTTL)) {
+		return nil, ErrLockTTLTooLong
+	}
+	return expires, nil
+}
+
+// capHold limits the expiry of a lock acquired at the given time to the maximum
+// hold time of its namespace. ErrLockMaxHoldExceeded is returned once the lock
+// has been held for the maximum hold time.
+func (n *Namespaces) capHold(namespace string, acquired time.Time, expires *timestamppb.Timestamp) (*timestamppb.Timestamp, error) {
+	config := n.config(namespace)
+	if config.MaxHold <= 0 {
+		return expires, nil
+	}
+
+	deadline := acquired.Add(config.MaxHold)
+	if !time.Now().Before(deadline) {
+		return nil, ErrLockMaxHoldExceeded
+	}
+	if expires.AsTime().After(deadline) {
+		return timestamppb.New(deadline), nil
+	}
+	return expires, nil
+}
+
+// acquired returns the time the lock stored under the uuid of lock was acquired
+// by its owner, or the current time if the owner doesn't hold the lock. Expired
+// locks are still held by their owner, unless the owner is acquiring them again.
+func (n *Namespaces) acquired(ctx context.Context, lock *pb.Lock, reacquire bool) (time.Time, error) {
+	if n.config(lock.Namespace).MaxHold <= 0 {
+		return time.Now(), nil
+	}
+
+	resp, err := n.next.Describe(ctx, &pb.DescribeRequest{Uuid: lock.Uuid})
+	switch {
+	case err == ErrLockNotFound:
+		return time.Now(), nil
+	case err != nil:
+		return time.Time{}, err
+	}
+
+	stored := resp.Lock
+	if stored.Owner != lock.Owner || stored.Acquired == nil {
+		return time.Now(), nil
+	}
+	if reacquire && time.Now().After(stored.Expires.AsTime()) {
+		return time.Now(), nil
+	}
+	return stored.Acquired.AsTime(), nil
+}
+
+// storedLock returns the lock passed to the wrapped service for a lock requested
+// in a namespace.
+func (n *Namespaces) storedLock(ctx context.Context, lock *pb.Lock) (*pb.Lock, error) {
+	key, err := storageKey(ctx, lock.GetNamespace(), lock.GetUuid())
+	if err != nil {
+		return nil, err
+	}
+
+	expires, err := n.expires(lock.Namespace, lock.Expires)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := proto.Clone(lock).(*pb.Lock)
+	stored.Uuid = key
+	stored.Expires = expires
+	return stored, nil
+}
+
+// namespacedLock converts a lock returned by the wrapped service back into a lock
+// of a namespace.
+func namespacedLock(namespace string, lock *pb.Lock) *pb.Lock {
+	lock.Uuid = strings.TrimPrefix(lock.Uuid, namespaceKey(namespace))
+	lock.Namespace = namespace
+	return lock
+}
+
+// checkCapacity returns ErrNamespaceFull if acquiring the lock stored under key
+// would exceed the maximum number of locks held in a namespace. Locks that are
+// already held, or have expired, are not counted. The check is best-effort: locks
+// acquired concurrently are not counted against each other, and no more than
+// maxCapacityScan locks are scanned, so that namespaces filled with expired locks
+// don't slow down every acquisition.
+func (n *Namespaces) checkCapacity(ctx context.Context, namespace, key string) error {
+	config := n.config(namespace)
+	if config.MaxLocks <= 0 {
+		return nil
+	}
+
+	// Locks already stored are not new to the namespace.
+	switch _, err := n.next.Describe(ctx, &pb.DescribeRequest{Uuid: key}); err {
+	case nil:
+		return nil
+	case ErrLockNotFound:
+		break
+	default:
+		return err
+	}
+
+	count, scanned := 0, 0
+	req := &pb.ListRequest{
+		Prefix:   namespaceKey(namespace),
+		PageSize: maxPageSize,
+	}
+	for scanned < maxCapacityScan {
+		resp, err := n.next.List(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		for _, lock := range resp.Locks {
+			if namespace == "" && reservedUuid(lock.Uuid) {
+				continue
+			}
+			if time.Now().Before(lock.Expires.AsTime()) {
+				count++
+			}
+			if count >= config.MaxLocks {
+				return ErrNamespaceFull
+			}
+		}
+
+		if resp.NextPageToken == "" {
+			break
+		}
+		scanned += len(resp.Locks)
+		req.PageToken = resp.NextPageToken
+	}
+	return nil
+}
+
+// TryLock will attempt to acquire a lock in a namespace, returning immediately if
+// the lock can not be acquired.
+func (n *Namespaces) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	lock, err := n.storedLock(ctx, in.Lock)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reentrant locks are still bound by the time they were first acquired.
+	acquired := time.Now()
+	if in.Reentrant {
+		if acquired, err = n.acquired(ctx, lock, true); err != nil {
+			return nil, err
+		}
+	}
+	if lock.Expires, err = n.capHold(lock.Namespace, acquired, lock.Expires); err != nil {
+		return nil, err
+	}
+
+	config := n.config(lock.Namespace)
+	if err := n.quotas.acquire(lock.Namespace, &config.Quota, lock.Uuid, lock.Owner); err != nil {
+		return nil, err
+	}
+
+	if err := n.checkCapacity(ctx, lock.Namespace, lock.Uuid); err != nil {
+		return nil, err
+	}
+
+	req := proto.Clone(in).(*pb.TryLockRequest)
+	req.Lock = lock
+	resp, err := n.next.TryLock(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	n.quotas.hold(lock.Namespace, &config.Quota, lock.Uuid, lock.Owner, lock.Expires.AsTime())
+	return resp, nil
+}
+
+// Lock will attempt to acquire a lock in a namespace, blocking until a lock is
+// acquired or until the timeout is met. The maximum hold time is applied to every
+// attempt, as the lock is only held from the attempt that acquires it.
+func (n *Namespaces) Lock(ctx context.Context, in *pb.LockRequest) (*pb.LockResponse, error) {
+	lock, err := n.storedLock(ctx, in.Lock)
+	if err != nil {
+		return nil, err
+	}
+
+	config := n.config(lock.Namespace)
+	lockCtx, expires := ctx, lock.Expires
+	if config.MaxHold > 0 {
+		lockCtx = withAttempt(ctx, func(req *pb.TryLockRequest) error {
+			// Reentrant locks are still bound by the time they were first acquired.
+			acquired := time.Now()
+			if in.Reentrant {
+				var err error
+				if acquired, err = n.acquired(ctx, lock, true); err != nil {
+					return err
+				}
+			}
+			capped, err := n.capHold(lock.Namespace, acquired, lock.Expires)
+			if err != nil {
+				return err
+			}
+
+			// The lock of the request is shared by every attempt.
+			req.Lock = proto.Clone(req.Lock).(*pb.Lock)
+			req.Lock.Expires = capped
+			expires = capped
+			return nil
+		})
+	}
+
+	if err := n.quotas.acquire(lock.Namespace, &config.Quota, lock.Uuid, lock.Owner); err != nil {
+		return nil, err
+	}
+
+	if err := n.checkCapacity(ctx, lock.Namespace, lock.Uuid); err != nil {
+		return nil, err
+	}
+
+	req := proto.Clone(in).(*pb.LockRequest)
+	req.Lock = lock
+	resp, err := n.next.Lock(lockCtx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	n.quotas.hold(lock.Namespace, &config.Quota, lock.Uuid, lock.Owner, expires.AsTime())
+	return resp, nil
+}
+
+// Refresh will refresh the lease of a lock in a namespace.
+func (n *Namespaces) Refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	lock, err := n.storedLock(ctx, in.Lock)
+	if err != nil {
+		return nil, err
+	}
+
+	acquired, err := n.acquired(ctx, lock, false)
+	if err != nil {
+		return nil, err
+	}
+	if lock.Expires, err = n.capHold(lock.Namespace, acquired, lock.Expires); err != nil {
+		return nil, err
+	}
+	req := proto.Clone(in).(*pb.RefreshRequest)
+	req.Lock = lock
+	resp, err := n.next.Refresh(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	n.quotas.refresh(lock.Namespace, lock.Uuid, lock.Expires.AsTime())
+	return resp, nil
+}
+
+// Transfer hands a lock in a namespace to a new owner.
+func (n *Namespaces) Transfer(ctx context.Context, in *pb.TransferRequest) (*pb.TransferResponse, error) {
+	lock, err := n.storedLock(ctx, in.Lock)
+	if err != nil {
+		return nil, err
+	}
+
+	expires, err := n.expires(lock.Namespace, in.Expires)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new owner acquires the lock now.
+	if expires, err = n.capHold(lock.Namespace, time.Now(), expires); err != nil {
+		return nil, err
+	}
+
+	req := proto.Clone(in).(*pb.TransferRequest)
+	req.Lock = lock
+	req.Expires = expires
+	resp, err := n.next.Transfer(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	config := n.config(lock.Namespace)
+	n.quotas.hold(lock.Namespace, &config.Quota, lock.Uuid, in.NewOwner, expires.AsTime())
+	return resp, nil
+}
+
+// Release will release a lock in a namespace.
+func (n *Namespaces) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	key, err := storageKey(ctx, in.Lock.GetNamespace(), in.Lock.GetUuid())
+	if err != nil {
+		return nil, err
+	}
+
+	req := proto.Clone(in).(*pb.ReleaseRequest)
+	req.Lock.Uuid = key
+	resp, err := n.next.Release(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reentrant locks are held until they are released as often as acquired.
+	if resp.Holds == 0 {
+		n.quotas.release(req.Lock.Namespace, key)
+	}
+	return resp, nil
+}
+
+// Put replaces the value stored under a lock in a namespace.
+func (n *Namespaces) Put(ctx context.Context, in *pb.PutRequest) (*pb.PutResponse, error) {
+	key, err := storageKey(ctx, in.Lock.GetNamespace(), in.Lock.GetUuid())
+	if err != nil {
+		return nil, err
+	}
+
+	req := proto.Clone(in).(*pb.PutRequest)
+	req.Lock.Uuid = key
+	return n.next.Put(ctx, req)
+}
+
+// Get returns the value stored under a lock in a namespace.
+func (n *Namespaces) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	key, err := storageKey(ctx, in.Namespace, in.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	return n.next.Get(ctx, &pb.GetRequest{Uuid: key})
+}
+
+// Describe returns a lock in a namespace.
+func (n *Namespaces) Describe(ctx context.Context, in *pb.DescribeRequest) (*pb.DescribeResponse, error) {
+	key, err := storageKey(ctx, in.Namespace, in.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := n.next.Describe(ctx, &pb.DescribeRequest{Uuid: key})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DescribeResponse{Lock: namespacedLock(in.Namespace, resp.Lock)}, nil
+}
+
+// Watch streams the changes of a lock in a namespace to its holder.
+func (n *Namespaces) Watch(in *pb.WatchRequest, stream pb.LockService_WatchServer) error {
+	key, err := storageKey(stream.Context(), in.Lock.GetNamespace(), in.Lock.GetUuid())
+	if err != nil {
+		return err
+	}
+
+	req := proto.Clone(in).(*pb.WatchRequest)
+	req.Lock.Uuid = key
+	return n.next.Watch(req, &namespacedWatch{LockService_WatchServer: stream, namespace: in.Lock.Namespace})
+}
+
+// namespacedWatch converts the locks of the events sent on a watch stream back
+// into locks of a namespace.
+type namespacedWatch struct {
+	pb.LockService_WatchServer
+	namespace string
+}
+
+func (s *namespacedWatch) Send(event *pb.WatchEvent) error {
+	if event.Lock != nil {
+		namespacedLock(s.namespace, event.Lock)
+	}
+	return s.LockService_WatchServer.Send(event)
+}
+
+// History returns the events of a lock in a namespace, newest first.
+func (n *Namespaces) History(ctx context.Context, in *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	key, err := storageKey(ctx, in.Namespace, in.Uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := n.next.History(ctx, &pb.HistoryRequest{Uuid: key, PageSize: in.PageSize})
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range resp.Events {
+		event.Uuid = strings.TrimPrefix(event.Uuid, namespaceKey(in.Namespace))
+	}
+	return resp, nil
+}
+
+// List returns the locks of a namespace with a uuid starting with a prefix.
+// Pages of the default namespace may hold fewer locks than requested, as locks of
+// named namespaces are left out.
+func (n *Namespaces) List(ctx context.Context, in *pb.ListRequest) (*pb.ListResponse, error) {
+	prefix, err := storageKey(ctx, in.Namespace, in.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &pb.ListRequest{
+		Prefix:   prefix,
+		PageSize: in.PageSize,
+	}
+	if in.PageToken != "" {
+		req.PageToken = namespaceKey(in.Namespace) + in.PageToken
+	}
+
+	listed, err := n.next.List(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.ListResponse{
+		NextPageToken: strings.TrimPrefix(listed.NextPageToken, namespaceKey(in.Namespace)),
+	}
+	for _, lock := range listed.Locks {
+		if in.Namespace == "" && reservedUuid(lock.Uuid) {
+			continue
+		}
+		resp.Locks = append(resp.Locks, namespacedLock(in.Namespace, lock))
+	}
+	return resp, nil
+}
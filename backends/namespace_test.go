@@ -0,0 +1,296 @@
+package backends
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func testNamespaces(t *testing.T, backend Backend) {
+	ctx := context.Background()
+	namespaces := NewNamespaces(backend, map[string]*NamespaceConfig{
+		"team-a": {
+			DefaultTTL: time.Minute,
+			MaxTTL:     time.Hour,
+			MaxLocks:   2,
+		},
+		"team-h": {
+			MaxHold: time.Second * 2,
+		},
+	})
+	expires := time.Now().Add(time.Minute)
+
+	// The same uuid can be held in every namespace at once.
+	for _, namespace := range []string{"", "team-a", "team-b"} {
+		if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+			Lock: &pb.Lock{
+				Uuid:      "shared",
+				Owner:     "owner-" + namespace,
+				Expires:   timestamppb.New(expires),
+				Namespace: namespace,
+			},
+		}); err != nil {
+			t.Fatalf("error trying to lock in namespace %q: %v", namespace, err)
+		}
+	}
+
+	described, err := namespaces.Describe(ctx, &pb.DescribeRequest{Uuid: "shared", Namespace: "team-a"})
+	if err != nil {
+		t.Fatalf("error describing lock: %v", err)
+	}
+	if described.Lock.Uuid != "shared" || described.Lock.Namespace != "team-a" || described.Lock.Owner != "owner-team-a" {
+		t.Fatalf("unexpected lock described: %v", described.Lock)
+	}
+
+	// Watched locks are reported in their namespace.
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	watch := &watchStream{ctx: watchCtx, events: make(chan *pb.WatchEvent, 10)}
+	watched := make(chan error, 1)
+	go func() {
+		watched <- namespaces.Watch(&pb.WatchRequest{
+			Lock: &pb.Lock{Uuid: "shared", Owner: "owner-team-a", Namespace: "team-a"},
+		}, watch)
+	}()
+	if event := <-watch.events; event.Lock.Uuid != "shared" || event.Lock.Namespace != "team-a" {
+		t.Fatalf("unexpected lock watched: %v", event.Lock)
+	}
+	cancelWatch()
+	if err := <-watched; err != context.Canceled {
+		t.Fatalf("expected watch to end with the cancelled context, instead: %v", err)
+	}
+
+	// Locks of named namespaces can't be reached from the default namespace.
+	if _, err := namespaces.Describe(ctx, &pb.DescribeRequest{Uuid: "ns/team-a/shared"}); err != ErrLockReservedUuid {
+		t.Fatalf("expected describe to fail with reserved uuid, instead: %v", err)
+	}
+
+	// Nor can the locks of elections, which acquire them through the namespaces.
+	election := NewElection(ServiceBackend(namespaces, backend))
+	if _, err := election.Campaign(ctx, &pb.CampaignRequest{Name: "reserved", Candidate: "a", Ttl: durationpb.New(time.Minute)}); err != nil {
+		t.Fatalf("error campaigning: %v", err)
+	}
+	for _, uuid := range []string{"election/reserved", "barrier/reserved", "latch/reserved"} {
+		if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+			Lock: &pb.Lock{Uuid: uuid, Owner: "b", Expires: timestamppb.New(expires)},
+		}); err != ErrLockReservedUuid {
+			t.Fatalf("expected lock of %s to fail with reserved uuid, instead: %v", uuid, err)
+		}
+	}
+	if _, err := namespaces.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{Uuid: "election/reserved", Owner: "a"},
+	}); err != ErrLockReservedUuid {
+		t.Fatalf("expected release of an election to fail with reserved uuid, instead: %v", err)
+	}
+	if _, err := election.Resign(ctx, &pb.ResignRequest{Name: "reserved", Candidate: "a"}); err != nil {
+		t.Fatalf("error resigning: %v", err)
+	}
+
+	if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "shared",
+			Owner:     "owner",
+			Expires:   timestamppb.New(expires),
+			Namespace: "team/a",
+		},
+	}); err != ErrInvalidNamespace {
+		t.Fatalf("expected lock to fail with invalid namespace, instead: %v", err)
+	}
+
+	// Locks requested without an expiry are given the default ttl of the namespace.
+	if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "default-ttl",
+			Owner:     "owner-team-a",
+			Namespace: "team-a",
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	described, err = namespaces.Describe(ctx, &pb.DescribeRequest{Uuid: "default-ttl", Namespace: "team-a"})
+	if err != nil {
+		t.Fatalf("error describing lock: %v", err)
+	}
+	if !described.Lock.Expires.AsTime().After(time.Now()) {
+		t.Fatalf("expected lock to expire in the future, instead: %v", described.Lock.Expires.AsTime())
+	}
+
+	// The namespace already holds its maximum number of locks.
+	if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "full",
+			Owner:     "owner-team-a",
+			Expires:   timestamppb.New(expires),
+			Namespace: "team-a",
+		},
+	}); err != ErrNamespaceFull {
+		t.Fatalf("expected lock to fail with namespace full, instead: %v", err)
+	}
+
+	// Locks already held are not new to a full namespace.
+	if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "default-ttl",
+			Owner:     "owner-team-a",
+			Namespace: "team-a",
+		},
+		Reentrant: true,
+	}); err != nil {
+		t.Fatalf("error locking again in a full namespace: %v", err)
+	}
+	if _, err := namespaces.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{Uuid: "default-ttl", Owner: "owner-team-a", Namespace: "team-a"},
+	}); err != nil {
+		t.Fatalf("error releasing lock: %v", err)
+	}
+
+	if _, err := namespaces.Refresh(ctx, &pb.RefreshRequest{
+		Lock: &pb.Lock{
+			Uuid:      "shared",
+			Owner:     "owner-team-a",
+			Expires:   timestamppb.New(time.Now().Add(time.Hour * 2)),
+			Namespace: "team-a",
+		},
+	}); err != ErrLockTTLTooLong {
+		t.Fatalf("expected refresh to fail with ttl too long, instead: %v", err)
+	}
+
+	listed, err := namespaces.List(ctx, &pb.ListRequest{Namespace: "team-a"})
+	if err != nil {
+		t.Fatalf("error listing locks: %v", err)
+	}
+	if len(listed.Locks) != 2 || listed.Locks[0].Uuid != "default-ttl" || listed.Locks[1].Uuid != "shared" {
+		t.Fatalf("unexpected locks listed: %v", listed.Locks)
+	}
+
+	if _, err := namespaces.Release(ctx, &pb.ReleaseRequest{
+		Lock: &pb.Lock{
+			Uuid:      "default-ttl",
+			Owner:     "owner-team-a",
+			Namespace: "team-a",
+		},
+	}); err != nil {
+		t.Fatalf("error releasing lock: %v", err)
+	}
+
+	// Releasing a lock frees up room in the namespace.
+	if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "full",
+			Owner:     "owner-team-a",
+			Expires:   timestamppb.New(expires),
+			Namespace: "team-a",
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	// Locks can't be held for longer than the maximum hold time, however often
+	// they are refreshed.
+	if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "stuck",
+			Owner:     "owner-team-h",
+			Expires:   timestamppb.New(time.Now().Add(time.Hour)),
+			Namespace: "team-h",
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	described, err = namespaces.Describe(ctx, &pb.DescribeRequest{Uuid: "stuck", Namespace: "team-h"})
+	if err != nil {
+		t.Fatalf("error describing lock: %v", err)
+	}
+	if described.Lock.Expires.AsTime().After(time.Now().Add(time.Second * 2)) {
+		t.Fatalf("expected expiry to be capped by the maximum hold time, instead: %v", described.Lock.Expires.AsTime())
+	}
+
+	time.Sleep(time.Second * 2)
+
+	if _, err := namespaces.Refresh(ctx, &pb.RefreshRequest{
+		Lock: &pb.Lock{
+			Uuid:      "stuck",
+			Owner:     "owner-team-h",
+			Expires:   timestamppb.New(time.Now().Add(time.Hour)),
+			Namespace: "team-h",
+		},
+	}); err != ErrLockMaxHoldExceeded {
+		t.Fatalf("expected refresh to fail with max hold exceeded, instead: %v", err)
+	}
+
+	// The lock is available once the maximum hold time has passed.
+	if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "stuck",
+			Owner:     "other-team-h",
+			Expires:   timestamppb.New(time.Now().Add(time.Minute)),
+			Namespace: "team-h",
+		},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	// Blocking calls are held for the maximum hold time from the moment they
+	// acquire the lock, not from the moment they started waiting.
+	start := time.Now()
+	if _, err := namespaces.Lock(ctx, &pb.LockRequest{
+		Lock: &pb.Lock{
+			Uuid:      "stuck",
+			Owner:     "waiter-team-h",
+			Expires:   timestamppb.New(time.Now().Add(time.Hour)),
+			Namespace: "team-h",
+		},
+		Timeout: durationpb.New(time.Second * 5),
+	}); err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+	described, err = namespaces.Describe(ctx, &pb.DescribeRequest{Uuid: "stuck", Namespace: "team-h"})
+	if err != nil {
+		t.Fatalf("error describing lock: %v", err)
+	}
+	if expires := described.Lock.Expires.AsTime(); !expires.After(start.Add(time.Second*2)) || expires.After(time.Now().Add(time.Second*2)) {
+		t.Fatalf("expected expiry to be capped from the acquisition, instead: %v", expires)
+	}
+
+	// Retried requests keep their request id, and return the response of the
+	// request that was applied.
+	if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{Uuid: "retried", Owner: "first", Expires: timestamppb.New(expires), Namespace: "team-b"},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+	transfer := &pb.TransferRequest{
+		Lock:      &pb.Lock{Uuid: "retried", Owner: "first", Namespace: "team-b"},
+		NewOwner:  "second",
+		Expires:   timestamppb.New(expires),
+		RequestId: "transfer",
+	}
+	release := &pb.ReleaseRequest{
+		Lock:      &pb.Lock{Uuid: "retried", Owner: "second", Namespace: "team-b"},
+		RequestId: "release",
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := namespaces.Transfer(ctx, transfer); err != nil {
+			t.Fatalf("error transferring lock, attempt %d: %v", i+1, err)
+		}
+	}
+	if _, err := namespaces.Release(ctx, release); err != nil {
+		t.Fatalf("error releasing lock: %v", err)
+	}
+	if _, err := namespaces.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{Uuid: "retried", Owner: "third", Expires: timestamppb.New(expires), Namespace: "team-b"},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+	if _, err := namespaces.Release(ctx, release); err != nil {
+		t.Fatalf("error retrying release: %v", err)
+	}
+	if described, err := namespaces.Describe(ctx, &pb.DescribeRequest{Uuid: "retried", Namespace: "team-b"}); err != nil || described.Lock.Owner != "third" {
+		t.Fatalf("expected retried release to keep the lock of its new owner, instead: %v, %v", described, err)
+	}
+}
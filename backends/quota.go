@@ -0,0 +1,323 @@
+package backends
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// maxOwnerBuckets is the most owners whose acquisition rate is tracked at
+	// once. Owners chosen by clients are unbounded, so the least recently used
+	// owner is forgotten to make room for a new one.
+	maxOwnerBuckets = 10000
+	// bucketSweepInterval is how often the buckets of owners that have refilled
+	// are forgotten.
+	bucketSweepInterval = time.Minute
+)
+
+// QuotaConfig limits the locks held in a namespace, and how often they are
+// acquired, both across the namespace and for each owner in it. Quotas are
+// enforced by each server in memory, before a request reaches the backend.
+type QuotaConfig struct {
+	// MaxHeld, if set, is the largest number of unexpired locks held at once.
+	MaxHeld int `mapstructure:"max_held"`
+
+	// MaxOwnerHeld, if set, is the largest number of unexpired locks held by a
+	// single owner at once.
+	MaxOwnerHeld int `mapstructure:"max_owner_held"`
+
+	// Rate, if set, is the number of locks that can be acquired per second.
+	Rate float64 `mapstructure:"rate"`
+
+	// Burst is the number of locks that can be acquired at once above Rate.
+	Burst int `mapstructure:"burst"`
+
+	// OwnerRate, if set, is the number of locks a single owner can acquire per
+	// second.
+	OwnerRate float64 `mapstructure:"owner_rate"`
+
+	// OwnerBurst is the number of locks a single owner can acquire at once above
+	// OwnerRate.
+	OwnerBurst int `mapstructure:"owner_burst"`
+}
+
+// QuotaError is returned to a caller that exceeded a quota. It matches
+// ErrQuotaExceeded, and is returned over gRPC as a resource exhausted status that
+// tells the caller when to retry.
+type QuotaError struct {
+	// Quota describes the exceeded quota.
+	Quota string
+
+	// RetryDelay is how long the caller should wait before retrying.
+	RetryDelay time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v: %s, retry in %v", ErrQuotaExceeded, e.Quota, e.RetryDelay)
+}
+
+// Is reports whether target is ErrQuotaExceeded.
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// GRPCStatus converts the error into a resource exhausted status with the retry
+// delay attached.
+func (e *QuotaError) GRPCStatus() *status.Status {
+	st := status.New(codes.ResourceExhausted, e.Error())
+	if detailed, err := st.WithDetails(
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(e.RetryDelay)},
+		&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     e.Quota,
+			Description: ErrQuotaExceeded.Error(),
+		}}},
+	); err == nil {
+		return detailed
+	}
+	return st
+}
+
+// bucket is a token bucket limiting the rate of acquisitions.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// rate and capacity are those the bucket was last refilled with.
+	rate     float64
+	capacity float64
+}
+
+// delay refills the bucket and returns how long to wait for a token to be
+// available.
+func (b *bucket) delay(now time.Time, rate float64, burst int) time.Duration {
+	capacity := math.Max(float64(burst), 1)
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	b.rate = rate
+	b.capacity = capacity
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled to its capacity by now, in which
+// case it can be forgotten, as a new bucket starts full.
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.capacity
+}
+
+// heldLock is a lock known to be held within a namespace.
+type heldLock struct {
+	owner   string
+	expires time.Time
+}
+
+// ownerKey identifies an owner within a namespace.
+type ownerKey struct {
+	namespace string
+	owner     string
+}
+
+// quotas tracks the locks held and acquired in every namespace.
+type quotas struct {
+	mu sync.Mutex
+	// held maps every namespace to its held locks, by storage key.
+	held map[string]map[string]*heldLock
+	// namespaces and owners hold the acquisition rate of namespaces and owners.
+	namespaces map[string]*bucket
+	owners     map[ownerKey]*bucket
+	// maxOwners is the most buckets kept in owners, and swept is when full
+	// buckets were last removed from it.
+	maxOwners int
+	swept     time.Time
+}
+
+// newQuotas creates a tracker with no locks held.
+func newQuotas() *quotas {
+	return &quotas{
+		held:       make(map[string]map[string]*heldLock),
+		namespaces: make(map[string]*bucket),
+		owners:     make(map[ownerKey]*bucket),
+		maxOwners:  maxOwnerBuckets,
+	}
+}
+
+// ownerBucket returns the bucket of an owner, creating it if needed. Buckets that
+// have refilled are removed every bucketSweepInterval, and the least recently used
+// bucket is removed to keep at most maxOwners. The caller must hold q.mu.
+func (q *quotas) ownerBucket(k ownerKey, now time.Time) *bucket {
+	if now.Sub(q.swept) >= bucketSweepInterval {
+		q.sweep(now)
+	}
+	if b, ok := q.owners[k]; ok {
+		return b
+	}
+
+	if len(q.owners) >= q.maxOwners {
+		q.sweep(now)
+	}
+	for len(q.owners) >= q.maxOwners {
+		var oldest ownerKey
+		var last time.Time
+		for key, b := range q.owners {
+			if last.IsZero() || b.last.Before(last) {
+				oldest, last = key, b.last
+			}
+		}
+		delete(q.owners, oldest)
+	}
+
+	b := &bucket{}
+	q.owners[k] = b
+	return b
+}
+
+// sweep removes the buckets of owners that have refilled. The caller must hold
+// q.mu.
+func (q *quotas) sweep(now time.Time) {
+	for k, b := range q.owners {
+		if b.full(now) {
+			delete(q.owners, k)
+		}
+	}
+	q.swept = now
+}
+
+// tracksHeld reports whether the locks held in a namespace need to be tracked.
+func tracksHeld(config *QuotaConfig) bool {
+	return config.MaxHeld > 0 || config.MaxOwnerHeld > 0
+}
+
+// acquire checks that owner can acquire the lock stored under key in a namespace,
+// and counts the acquisition against its rate. A *QuotaError is returned if a
+// quota would be exceeded. Locks already held by owner can always be acquired.
+func (q *quotas) acquire(namespace string, config *QuotaConfig, key, owner string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	if tracksHeld(config) {
+		if held, ok := q.held[namespace][key]; ok && held.owner == owner && now.Before(held.expires) {
+			return nil
+		}
+
+		// Count the unexpired locks, and find the earliest one to expire.
+		var count, ownerCount int
+		var next, ownerNext time.Time
+		for k, held := range q.held[namespace] {
+			if !now.Before(held.expires) {
+				delete(q.held[namespace], k)
+				continue
+			}
+
+			count++
+			if next.IsZero() || held.expires.Before(next) {
+				next = held.expires
+			}
+			if held.owner == owner {
+				ownerCount++
+				if ownerNext.IsZero() || held.expires.Before(ownerNext) {
+					ownerNext = held.expires
+				}
+			}
+		}
+
+		if config.MaxHeld > 0 && count >= config.MaxHeld {
+			return &QuotaError{
+				Quota:      fmt.Sprintf("locks held in namespace %q", namespace),
+				RetryDelay: next.Sub(now),
+			}
+		}
+		if config.MaxOwnerHeld > 0 && ownerCount >= config.MaxOwnerHeld {
+			return &QuotaError{
+				Quota:      fmt.Sprintf("locks held by owner %q in namespace %q", owner, namespace),
+				RetryDelay: ownerNext.Sub(now),
+			}
+		}
+	}
+
+	var limited, ownerLimited *bucket
+	if config.Rate > 0 {
+		limited = q.namespaces[namespace]
+		if limited == nil {
+			limited = &bucket{}
+			q.namespaces[namespace] = limited
+		}
+
+		if delay := limited.delay(now, config.Rate, config.Burst); delay > 0 {
+			return &QuotaError{
+				Quota:      fmt.Sprintf("lock acquisitions in namespace %q", namespace),
+				RetryDelay: delay,
+			}
+		}
+	}
+
+	if config.OwnerRate > 0 {
+		ownerLimited = q.ownerBucket(ownerKey{namespace: namespace, owner: owner}, now)
+
+		if delay := ownerLimited.delay(now, config.OwnerRate, config.OwnerBurst); delay > 0 {
+			return &QuotaError{
+				Quota:      fmt.Sprintf("lock acquisitions by owner %q in namespace %q", owner, namespace),
+				RetryDelay: delay,
+			}
+		}
+	}
+
+	// Only count the acquisition once every quota allows it.
+	if limited != nil {
+		limited.tokens--
+	}
+	if ownerLimited != nil {
+		ownerLimited.tokens--
+	}
+	return nil
+}
+
+// hold records that owner holds the lock stored under key in a namespace until it
+// expires.
+func (q *quotas) hold(namespace string, config *QuotaConfig, key, owner string, expires time.Time) {
+	if !tracksHeld(config) {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.held[namespace] == nil {
+		q.held[namespace] = make(map[string]*heldLock)
+	}
+	q.held[namespace][key] = &heldLock{owner: owner, expires: expires}
+}
+
+// refresh extends the expiry of the lock stored under key in a namespace.
+func (q *quotas) refresh(namespace, key string, expires time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if held, ok := q.held[namespace][key]; ok {
+		held.expires = expires
+	}
+}
+
+// release removes the lock stored under key in a namespace.
+func (q *quotas) release(namespace, key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.held[namespace], key)
+	if len(q.held[namespace]) == 0 {
+		delete(q.held, namespace)
+	}
+}
@@ -0,0 +1,138 @@
+package backends
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuotasHeld(t *testing.T) {
+	q := newQuotas()
+	config := &QuotaConfig{
+		MaxHeld:      2,
+		MaxOwnerHeld: 1,
+	}
+	expires := time.Now().Add(time.Minute)
+
+	if err := q.acquire("ns", config, "1", "a"); err != nil {
+		t.Fatalf("unexpected error acquiring: %v", err)
+	}
+	q.hold("ns", config, "1", "a", expires)
+
+	// Owners can acquire the locks they already hold.
+	if err := q.acquire("ns", config, "1", "a"); err != nil {
+		t.Fatalf("unexpected error acquiring: %v", err)
+	}
+
+	// a already holds as many locks as it can.
+	err := q.acquire("ns", config, "2", "a")
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded, instead: %v", err)
+	}
+
+	// The retry delay is exposed in the status details.
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("expected resource exhausted status, instead: %v", st.Code())
+	}
+	var retry *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retry = info
+		}
+	}
+	if retry == nil {
+		t.Fatalf("expected retry info detail, instead: %v", st.Details())
+	}
+	if delay := retry.RetryDelay.AsDuration(); delay <= 0 || delay > time.Minute {
+		t.Fatalf("unexpected retry delay: %v", delay)
+	}
+
+	if err := q.acquire("ns", config, "2", "b"); err != nil {
+		t.Fatalf("unexpected error acquiring: %v", err)
+	}
+	q.hold("ns", config, "2", "b", expires)
+
+	// The namespace holds as many locks as it can.
+	if err := q.acquire("ns", config, "3", "c"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded, instead: %v", err)
+	}
+
+	// Other namespaces are not affected.
+	if err := q.acquire("other", config, "3", "c"); err != nil {
+		t.Fatalf("unexpected error acquiring: %v", err)
+	}
+
+	// Released and expired locks are no longer counted.
+	q.release("ns", "1")
+	q.refresh("ns", "2", time.Now())
+	if err := q.acquire("ns", config, "3", "a"); err != nil {
+		t.Fatalf("unexpected error acquiring: %v", err)
+	}
+}
+
+func TestQuotasRate(t *testing.T) {
+	q := newQuotas()
+	config := &QuotaConfig{
+		Rate:       1,
+		Burst:      3,
+		OwnerRate:  1,
+		OwnerBurst: 2,
+	}
+
+	// a can burst up to its own limit.
+	for i := 0; i < 2; i++ {
+		if err := q.acquire("ns", config, "1", "a"); err != nil {
+			t.Fatalf("unexpected error acquiring: %v", err)
+		}
+	}
+
+	var quotaErr *QuotaError
+	if err := q.acquire("ns", config, "1", "a"); !errors.As(err, &quotaErr) {
+		t.Fatalf("expected quota exceeded, instead: %v", err)
+	}
+	if quotaErr.RetryDelay <= 0 || quotaErr.RetryDelay > time.Second {
+		t.Fatalf("unexpected retry delay: %v", quotaErr.RetryDelay)
+	}
+
+	// The acquisition refused above did not count against the namespace.
+	if err := q.acquire("ns", config, "1", "b"); err != nil {
+		t.Fatalf("unexpected error acquiring: %v", err)
+	}
+	if err := q.acquire("ns", config, "1", "c"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded, instead: %v", err)
+	}
+}
+
+func TestQuotasOwnerBuckets(t *testing.T) {
+	q := newQuotas()
+	q.maxOwners = 2
+	config := &QuotaConfig{
+		OwnerRate:  1,
+		OwnerBurst: 1,
+	}
+
+	for _, owner := range []string{"a", "b", "c"} {
+		if err := q.acquire("ns", config, "1", owner); err != nil {
+			t.Fatalf("unexpected error acquiring: %v", err)
+		}
+	}
+
+	// The least recently used owner is forgotten to make room for c.
+	if len(q.owners) != 2 {
+		t.Fatalf("expected 2 owner buckets, instead: %d", len(q.owners))
+	}
+	if _, ok := q.owners[ownerKey{namespace: "ns", owner: "a"}]; ok {
+		t.Fatalf("expected the bucket of a to be evicted")
+	}
+
+	// Buckets that have refilled are swept.
+	q.sweep(time.Now().Add(time.Second))
+	if len(q.owners) != 0 {
+		t.Fatalf("expected refilled owner buckets to be swept, instead: %d", len(q.owners))
+	}
+}
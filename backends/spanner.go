@@ -2,19 +2,80 @@ package backends
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/spanner"
 	admin "cloud.google.com/go/spanner/admin/database/apiv1"
+	"cloud.google.com/go/spanner/spansql"
 	pb "github.com/gcp-services/lock/storage"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"google.golang.org/genproto/googleapis/spanner/admin/database/v1"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// spannerSchema holds the DDL statements used to create the Locks, Counters,
+// Requests and AuditEvents tables.
+var spannerSchema = []string{
+	`CREATE TABLE Locks (
+		uuid STRING(MAX) NOT NULL,
+		owner STRING(MAX) NOT NULL,
+		expires TIMESTAMP NOT NULL,
+		acquired TIMESTAMP,
+		holds INT64,
+		priority INT64,
+		preemptible BOOL,
+		labels STRING(MAX),
+		payload BYTES(MAX),
+		token STRING(MAX),
+		etag STRING(MAX),
+		lock_delay INT64,
+		value BYTES(MAX),
+		term INT64,
+		) PRIMARY KEY (uuid)`,
+	`CREATE TABLE Counters (
+		name STRING(MAX) NOT NULL,
+		target INT64 NOT NULL,
+		count INT64 NOT NULL,
+		expires TIMESTAMP NOT NULL,
+		) PRIMARY KEY (name)`,
+	`CREATE TABLE Requests (
+		id STRING(MAX) NOT NULL,
+		response BYTES(MAX) NOT NULL,
+		expires TIMESTAMP NOT NULL,
+		) PRIMARY KEY (id)`,
+	`CREATE TABLE AuditEvents (
+		uuid STRING(MAX) NOT NULL,
+		time TIMESTAMP NOT NULL,
+		id STRING(MAX) NOT NULL,
+		type STRING(MAX) NOT NULL,
+		owner STRING(MAX) NOT NULL,
+		principal STRING(MAX),
+		event BYTES(MAX) NOT NULL,
+		) PRIMARY KEY (uuid, time DESC, id)`,
+}
+
+// lockColumns are the columns read and written for every lock.
+var lockColumns = []string{"uuid", "owner", "expires", "acquired", "holds", "priority", "preemptible", "labels", "payload", "token", "etag", "lock_delay", "value", "term"}
+
+// counterColumns are the columns read and written for every counter.
+var counterColumns = []string{"name", "target", "count", "expires"}
+
+// requestColumns are the columns read and written for every applied request.
+var requestColumns = []string{"id", "response", "expires"}
+
+// auditColumns are the columns written for every audit event.
+var auditColumns = []string{"uuid", "time", "id", "type", "owner", "principal", "event"}
+
 // Spanner is an implementation of the Lock server that uses Spanner as a backing store.
 type Spanner struct {
 	client       *spanner.Client
@@ -22,6 +83,9 @@ type Spanner struct {
 	databasePath string
 	databaseName string
 	instance     string
+
+	// stop stops purging expired requests.
+	stop context.CancelFunc
 }
 
 // NewSpanner creates a new connection to Spanner and returns the Spanner object.
@@ -47,21 +111,53 @@ func NewSpanner(ctx context.Context, database string, opts ...option.ClientOptio
 		instance:     instance,
 	}
 
+	// Spanner doesn't expire rows, so the responses of requests are purged once
+	// their retries are no longer expected.
+	purgeCtx, stop := context.WithCancel(context.Background())
+	sp.stop = stop
+	go sp.purgeRequests(purgeCtx)
+
 	return sp, nil
 }
 
+// purgeRequests deletes expired requests every requestPurgeInterval until ctx is
+// done.
+func (s *Spanner) purgeRequests(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(requestPurgeInterval):
+		}
+
+		if _, err := s.purgeExpiredRequests(ctx); err != nil && ctx.Err() == nil {
+			zap.L().Warn("error purging expired requests", zap.String("backend", "spanner"), zap.Error(err))
+		}
+	}
+}
+
+// purgeExpiredRequests deletes the recorded responses of requests that have
+// expired, returning the number of requests deleted.
+func (s *Spanner) purgeExpiredRequests(ctx context.Context) (int64, error) {
+	return s.client.PartitionedUpdate(ctx, spanner.Statement{
+		SQL:    "DELETE FROM Requests WHERE expires < @now",
+		Params: map[string]interface{}{"now": time.Now()},
+	})
+}
+
+// Close closes the clients of the Spanner database.
+func (s *Spanner) Close() error {
+	s.stop()
+	s.client.Close()
+	return s.admin.Close()
+}
+
 // CreateSchema creates the schema for this database.
 func (s *Spanner) CreateSchema(ctx context.Context, testing bool) error {
 	if testing {
 		op, err := s.admin.UpdateDatabaseDdl(ctx, &database.UpdateDatabaseDdlRequest{
-			Database: s.databaseName,
-			Statements: []string{
-				`CREATE TABLE Locks (
-					uuid STRING(MAX) NOT NULL,
-					owner STRING(MAX) NOT NULL,
-					expires TIMESTAMP NOT NULL,
-					) PRIMARY KEY (uuid)`,
-			},
+			Database:   s.databaseName,
+			Statements: spannerSchema,
 		})
 		if err != nil {
 			return err
@@ -85,13 +181,7 @@ func (s *Spanner) CreateSchema(ctx context.Context, testing bool) error {
 	op, err := s.admin.CreateDatabase(ctx, &database.CreateDatabaseRequest{
 		Parent:          s.instance,
 		CreateStatement: fmt.Sprintf("CREATE DATABASE %s", s.databaseName),
-		ExtraStatements: []string{
-			`CREATE TABLE Locks (
-						uuid STRING(MAX) NOT NULL,
-						owner STRING(MAX) NOT NULL,
-						expires TIMESTAMP NOT NULL,
-						) PRIMARY KEY (uuid)`,
-		},
+		ExtraStatements: spannerSchema,
 	})
 
 	if err != nil {
@@ -104,49 +194,318 @@ func (s *Spanner) CreateSchema(ctx context.Context, testing bool) error {
 	return nil
 }
 
-func (s *Spanner) applyLock(txn *spanner.ReadWriteTransaction, in *pb.TryLockRequest) error {
-	ts, err := ptypes.Timestamp(in.Lock.Expires)
+// MigrateSchema brings the schema of an existing database, such as one created by
+// an earlier version, up to date. Missing tables are created, and the columns
+// missing from existing tables are added. Columns added since tables were first
+// created are all nullable, so rows already stored are kept as they are.
+func (s *Spanner) MigrateSchema(ctx context.Context) error {
+	statements, err := s.migrations(ctx)
+	if err != nil || len(statements) == 0 {
+		return err
+	}
+
+	for _, statement := range statements {
+		zap.L().Info("migrating schema", zap.String("backend", "spanner"), zap.String("statement", statement))
+	}
+	op, err := s.admin.UpdateDatabaseDdl(ctx, &database.UpdateDatabaseDdlRequest{
+		Database:   s.databasePath,
+		Statements: statements,
+	})
 	if err != nil {
 		return err
 	}
-	m := spanner.InsertOrUpdate("Locks", []string{"uuid", "owner", "expires"}, []interface{}{
-		in.Lock.Uuid,
-		in.Lock.Owner,
+	return op.Wait(ctx)
+}
+
+// migrations returns the DDL statements creating the tables and columns of
+// spannerSchema that the database is missing.
+func (s *Spanner) migrations(ctx context.Context) ([]string, error) {
+	resp, err := s.admin.GetDatabaseDdl(ctx, &database.GetDatabaseDdlRequest{
+		Database: s.databasePath,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Statements that can't be parsed, such as those of tables unrelated to locks
+	// using newer syntax, are left alone.
+	existing := make(map[string]map[string]bool)
+	for _, statement := range resp.Statements {
+		stmt, err := spansql.ParseDDLStmt(statement)
+		if err != nil {
+			continue
+		}
+		if table, ok := stmt.(*spansql.CreateTable); ok {
+			columns := make(map[string]bool)
+			for _, column := range table.Columns {
+				columns[column.Name] = true
+			}
+			existing[table.Name] = columns
+		}
+	}
+
+	var statements []string
+	for _, statement := range spannerSchema {
+		stmt, err := spansql.ParseDDLStmt(statement)
+		if err != nil {
+			return nil, err
+		}
+		table := stmt.(*spansql.CreateTable)
+
+		columns, ok := existing[table.Name]
+		if !ok {
+			statements = append(statements, statement)
+			continue
+		}
+		for _, column := range table.Columns {
+			if !columns[column.Name] {
+				statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table.Name, column.SQL()))
+			}
+		}
+	}
+	return statements, nil
+}
+
+// rowReader is implemented by both read-only and read-write Spanner transactions.
+type rowReader interface {
+	ReadRow(ctx context.Context, table string, key spanner.Key, columns []string) (*spanner.Row, error)
+}
+
+// readLock reads the lock stored under uuid. Callers are expected to check for a
+// codes.NotFound error when the lock does not exist.
+func (s *Spanner) readLock(ctx context.Context, txn rowReader, uuid string) (*pb.Lock, error) {
+	row, err := txn.ReadRow(ctx, "Locks", spanner.Key{uuid}, lockColumns)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLockRow(row)
+}
+
+// decodeLockRow decodes a row of lockColumns read from the Locks table.
+func decodeLockRow(row *spanner.Row) (*pb.Lock, error) {
+	readLock := &pb.Lock{}
+	var expires time.Time
+	var acquired spanner.NullTime
+	var holds, priority, lockDelay, term spanner.NullInt64
+	var preemptible spanner.NullBool
+	var labels, token, etag spanner.NullString
+	if err := row.Columns(&readLock.Uuid, &readLock.Owner, &expires, &acquired, &holds, &priority, &preemptible, &labels, &readLock.Payload, &token, &etag, &lockDelay, &readLock.Value, &term); err != nil {
+		return nil, err
+	}
+
+	readLock.Expires = timestamppb.New(expires)
+	if acquired.Valid {
+		readLock.Acquired = timestamppb.New(acquired.Time)
+	}
+
+	// Locks written before the holds column existed are held once.
+	readLock.Holds = 1
+	if holds.Valid {
+		readLock.Holds = holds.Int64
+	}
+	readLock.Priority = int32(priority.Int64)
+	readLock.Preemptible = preemptible.Bool
+	readLock.Token = token.StringVal
+	readLock.Etag = etag.StringVal
+	readLock.Term = term.Int64
+	if lockDelay.Valid {
+		readLock.LockDelay = durationpb.New(time.Duration(lockDelay.Int64))
+	}
+
+	// Labels are stored as a JSON object.
+	if labels.Valid {
+		if err := json.Unmarshal([]byte(labels.StringVal), &readLock.Labels); err != nil {
+			return nil, err
+		}
+	}
+	return readLock, nil
+}
+
+// applyLock writes lock as the new state of the lock stored under its uuid, with a
+// new etag.
+func (s *Spanner) applyLock(txn *spanner.ReadWriteTransaction, lock *pb.Lock) error {
+	lock.Etag = uuid.New().String()
+
+	ts, err := ptypes.Timestamp(lock.Expires)
+	if err != nil {
+		return err
+	}
+
+	var labels spanner.NullString
+	if len(lock.Labels) > 0 {
+		encoded, err := json.Marshal(lock.Labels)
+		if err != nil {
+			return err
+		}
+		labels = spanner.NullString{StringVal: string(encoded), Valid: true}
+	}
+
+	m := spanner.InsertOrUpdate("Locks", lockColumns, []interface{}{
+		lock.Uuid,
+		lock.Owner,
 		ts,
+		lock.Acquired.AsTime(),
+		lock.Holds,
+		int64(lock.Priority),
+		lock.Preemptible,
+		labels,
+		lock.Payload,
+		lock.Token,
+		lock.Etag,
+		int64(lock.LockDelay.AsDuration()),
+		lock.Value,
+		lock.Term,
 	})
 	return txn.BufferWrite([]*spanner.Mutation{m})
 }
 
-// TryLock will attempt to acquire a lock. If a lock can not be acquired, the function
-// will return immediately with the reason for lock acquisition failure.
-func (s *Spanner) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
-	if _, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		row, err := txn.ReadRow(ctx, "Locks", spanner.Key{in.Lock.GetUuid()}, []string{"uuid", "owner", "expires"})
+// applyNewLock writes lock as taken by a new owner within txn. Fenced locks are
+// given the next term, counted in the counter stored under their uuid, which
+// outlives the lock itself.
+func (s *Spanner) applyNewLock(ctx context.Context, txn *spanner.ReadWriteTransaction, lock *pb.Lock) error {
+	if fenced(lock.Uuid) {
+		row, err := txn.ReadRow(ctx, "Counters", spanner.Key{lock.Uuid}, []string{"count"})
 		switch {
 		case spanner.ErrCode(err) == codes.NotFound:
-			return s.applyLock(txn, in)
+			break
 		case err != nil:
 			return err
+		default:
+			if err := row.Columns(&lock.Term); err != nil {
+				return err
+			}
 		}
+		lock.Term++
 
-		// A lock entry was found, validate it.
-		readLock := pb.Lock{}
-		var expires time.Time
-		if err = row.Columns(&readLock.Uuid, &readLock.Owner, &expires); err != nil {
+		m := spanner.InsertOrUpdate("Counters", counterColumns, []interface{}{
+			lock.Uuid,
+			int64(0),
+			lock.Term,
+			lock.Expires.AsTime(),
+		})
+		if err := txn.BufferWrite([]*spanner.Mutation{m}); err != nil {
 			return err
 		}
+	}
+	return s.applyLock(txn, lock)
+}
 
-		// Check if this lock is expired and has not been refreshed. Claim this lock
-		// if the lock has expired.
-		if time.Now().After(expires) {
-			return s.applyLock(txn, in)
+// idempotent runs apply, which fills resp, unless the request identified by key
+// was already applied within txn. The response of an applied request is recorded
+// in the same transaction, and returned in resp when the request is retried.
+func (s *Spanner) idempotent(ctx context.Context, txn *spanner.ReadWriteTransaction, key string, resp proto.Message, apply func() error) error {
+	appliedFrom(ctx).reset()
+	if key == "" {
+		return apply()
+	}
+
+	row, err := txn.ReadRow(ctx, "Requests", spanner.Key{key}, requestColumns)
+	switch {
+	case spanner.ErrCode(err) == codes.NotFound:
+		break
+	case err != nil:
+		return err
+	default:
+		var id string
+		var recorded []byte
+		var expires time.Time
+		if err := row.Columns(&id, &recorded, &expires); err != nil {
+			return err
+		}
+		if time.Now().Before(expires) {
+			appliedFrom(ctx).replay()
+			return proto.Unmarshal(recorded, resp)
 		}
-		return ErrLockBusy
+	}
+
+	if err := apply(); err != nil {
+		return err
+	}
+
+	recorded, err := proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	m := spanner.InsertOrUpdate("Requests", requestColumns, []interface{}{
+		key,
+		recorded,
+		time.Now().Add(requestTTL),
+	})
+	return txn.BufferWrite([]*spanner.Mutation{m})
+}
+
+// TryLock will attempt to acquire a lock. If a lock can not be acquired, the function
+// will return immediately with the reason for lock acquisition failure.
+func (s *Spanner) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	if err := validateLock(in.Lock); err != nil {
+		return nil, err
+	}
+
+	var resp *pb.TryLockResponse
+	if _, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		resp = &pb.TryLockResponse{}
+		return s.idempotent(ctx, txn, requestKey("TryLock", in.Lock, in.RequestId), resp, func() error {
+			lock, err := s.tryLock(ctx, txn, in)
+			if err != nil {
+				return err
+			}
+			resp.Holds = lock.Holds
+			resp.Token = lock.Token
+			resp.Etag = lock.Etag
+			return nil
+		})
 	}); err != nil {
 		return nil, err
 	}
 
-	return &pb.TryLockResponse{}, nil
+	return resp, nil
+}
+
+// tryLock acquires a lock within txn, and returns the lock written.
+func (s *Spanner) tryLock(ctx context.Context, txn *spanner.ReadWriteTransaction, in *pb.TryLockRequest) (*pb.Lock, error) {
+	readLock, err := s.readLock(ctx, txn, in.Lock.GetUuid())
+	switch {
+	case spanner.ErrCode(err) == codes.NotFound:
+		if err := checkEtag(in.Lock, nil); err != nil {
+			return nil, err
+		}
+		lock := newLock(in)
+		return lock, s.applyNewLock(ctx, txn, lock)
+	case err != nil:
+		return nil, err
+	}
+
+	if err := checkEtag(in.Lock, readLock); err != nil {
+		return nil, err
+	}
+
+	// Check if this lock is expired and has not been refreshed. Claim this lock
+	// if the lock has expired.
+	if time.Now().After(readLock.Expires.AsTime()) {
+		// Locks that expired without being released are kept from others
+		// during their lock-delay.
+		if delayed(in, readLock) {
+			return nil, ErrLockBusy
+		}
+		appliedFrom(ctx).displace(readLock, true)
+		lock := newLock(in)
+		return lock, s.applyNewLock(ctx, txn, lock)
+	}
+
+	// Acquire the lock again if it is reentrant and already held by this owner,
+	// without shortening the current expiry.
+	if in.Reentrant && owns(in.Lock, readLock) {
+		lock := reentrantLock(in, readLock)
+		return lock, s.applyLock(txn, lock)
+	}
+
+	// Revoke the lock from its owner in favour of a more urgent request.
+	if preempts(in, readLock) {
+		appliedFrom(ctx).displace(readLock, false)
+		lock := newLock(in)
+		return lock, s.applyNewLock(ctx, txn, lock)
+	}
+	return nil, ErrLockBusy
 }
 
 // Lock will attempt to acquire a lock, blocking until a lock is acquired or until
@@ -157,69 +516,375 @@ func (s *Spanner) Lock(ctx context.Context, in *pb.LockRequest) (*pb.LockRespons
 
 // Refresh will refresh a lock lease and extend the time a valid lock is held.
 func (s *Spanner) Refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	var resp *pb.RefreshResponse
+	if _, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		resp = &pb.RefreshResponse{}
+		return s.idempotent(ctx, txn, requestKey("Refresh", in.Lock, in.RequestId), resp, func() error {
+			readLock, err := s.readLock(ctx, txn, in.Lock.GetUuid())
+			switch {
+			case spanner.ErrCode(err) == codes.NotFound:
+				return ErrLockNotFound
+			case err != nil:
+				return err
+			}
+
+			if !owns(in.Lock, readLock) {
+				return ErrLockInvalidOwner
+			}
+
+			if err := checkEtag(in.Lock, readLock); err != nil {
+				return err
+			}
+
+			// Check if the refresh time is before the current expiry time.
+			ts, err := ptypes.Timestamp(in.Lock.Expires)
+			if err != nil {
+				return err
+			}
+
+			if ts.Before(readLock.Expires.AsTime()) {
+				return ErrLockInvalidRefresh
+			}
+
+			lock := refreshLock(in, readLock)
+			if err := s.applyLock(txn, lock); err != nil {
+				return err
+			}
+			resp.Etag = lock.Etag
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
 
+	return resp, nil
+}
+
+// Transfer hands a lock held by its current owner to a new owner, without the lock
+// becoming free in between.
+func (s *Spanner) Transfer(ctx context.Context, in *pb.TransferRequest) (*pb.TransferResponse, error) {
+	var resp *pb.TransferResponse
 	if _, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		row, err := txn.ReadRow(ctx, "Locks", spanner.Key{in.Lock.GetUuid()}, []string{"uuid", "owner", "expires"})
-		switch {
-		case spanner.ErrCode(err) == codes.NotFound:
-			return ErrLockNotFound
-		case err != nil:
-			return err
-		}
+		resp = &pb.TransferResponse{}
+		return s.idempotent(ctx, txn, requestKey("Transfer", in.Lock, in.RequestId), resp, func() error {
+			readLock, err := s.readLock(ctx, txn, in.Lock.GetUuid())
+			switch {
+			case spanner.ErrCode(err) == codes.NotFound:
+				return ErrLockNotFound
+			case err != nil:
+				return err
+			}
+
+			if !owns(in.Lock, readLock) {
+				return ErrLockInvalidOwner
+			}
+
+			if err := checkEtag(in.Lock, readLock); err != nil {
+				return err
+			}
+
+			if time.Now().After(readLock.Expires.AsTime()) {
+				return ErrLockExpired
+			}
+
+			// The new owner holds the lock once, starting now.
+			lock := transferLock(in, readLock)
+			if err := s.applyNewLock(ctx, txn, lock); err != nil {
+				return err
+			}
+			resp.Token = lock.Token
+			resp.Etag = lock.Etag
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
 
-		// A lock entry was found, validate it.
-		readLock := pb.Lock{}
-		var expires time.Time
-		if err = row.Columns(&readLock.Uuid, &readLock.Owner, &expires); err != nil {
-			return err
+	return resp, nil
+}
+
+// Put replaces the value stored under a lock held by its owner.
+func (s *Spanner) Put(ctx context.Context, in *pb.PutRequest) (*pb.PutResponse, error) {
+	var resp *pb.PutResponse
+	if _, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		resp = &pb.PutResponse{}
+		return s.idempotent(ctx, txn, requestKey("Put", in.Lock, in.RequestId), resp, func() error {
+			readLock, err := s.readLock(ctx, txn, in.Lock.GetUuid())
+			switch {
+			case spanner.ErrCode(err) == codes.NotFound:
+				return ErrLockNotFound
+			case err != nil:
+				return err
+			}
+
+			if !owns(in.Lock, readLock) {
+				return ErrLockInvalidOwner
+			}
+
+			if err := checkEtag(in.Lock, readLock); err != nil {
+				return err
+			}
+
+			if time.Now().After(readLock.Expires.AsTime()) {
+				return ErrLockExpired
+			}
+
+			lock := putLock(in, readLock)
+			if err := validateLock(lock); err != nil {
+				return err
+			}
+
+			if err := s.applyLock(txn, lock); err != nil {
+				return err
+			}
+			resp.Etag = lock.Etag
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Get returns the value stored under a lock, while the lock is held.
+func (s *Spanner) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	return doGet(ctx, s, in)
+}
+
+// Release will release a lock that was previously acquired.
+func (s *Spanner) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	var resp *pb.ReleaseResponse
+	if _, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		resp = &pb.ReleaseResponse{}
+		return s.idempotent(ctx, txn, requestKey("Release", in.Lock, in.RequestId), resp, func() error {
+			readLock, err := s.readLock(ctx, txn, in.Lock.GetUuid())
+			switch {
+			case spanner.ErrCode(err) == codes.NotFound:
+				// Releasing a lock that no longer exists succeeds, so that a
+				// release retried after its response was lost does not fail.
+				return checkEtag(in.Lock, nil)
+			case err != nil:
+				return err
+			}
+
+			if !owns(in.Lock, readLock) {
+				return ErrLockInvalidOwner
+			}
+
+			if err := checkEtag(in.Lock, readLock); err != nil {
+				return err
+			}
+
+			// Keep reentrant locks that are still held by their owner.
+			if readLock.Holds > 1 {
+				resp.Holds = readLock.Holds - 1
+				resp.Etag = uuid.New().String()
+				m := spanner.Update("Locks", []string{"uuid", "holds", "etag"}, []interface{}{
+					in.Lock.GetUuid(),
+					resp.Holds,
+					resp.Etag,
+				})
+				return txn.BufferWrite([]*spanner.Mutation{m})
+			}
+
+			m := spanner.Delete("Locks", spanner.Key{in.Lock.GetUuid()})
+			return txn.BufferWrite([]*spanner.Mutation{m})
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Describe returns the lock currently stored under a uuid, including its labels
+// and payload.
+func (s *Spanner) Describe(ctx context.Context, in *pb.DescribeRequest) (*pb.DescribeResponse, error) {
+	return doDescribe(ctx, s, in)
+}
+
+// List returns the locks stored under uuids starting with a prefix, in uuid order.
+// Locks are listed whether or not they have expired.
+func (s *Spanner) List(ctx context.Context, in *pb.ListRequest) (*pb.ListResponse, error) {
+	limit := pageSize(in)
+
+	// Start from the prefix, or from just after the last lock of the previous page.
+	keys := spanner.KeyRange{
+		Start: spanner.Key{in.Prefix},
+		End:   spanner.Key{},
+		Kind:  spanner.ClosedClosed,
+	}
+	if in.PageToken != "" {
+		keys.Start = spanner.Key{in.PageToken}
+		keys.Kind = spanner.OpenClosed
+	}
+
+	resp := &pb.ListResponse{}
+	iter := s.client.Single().ReadWithOptions(ctx, "Locks", keys, lockColumns, &spanner.ReadOptions{
+		Limit: limit + 1,
+	})
+	defer iter.Stop()
+
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
 		}
 
-		// Check if the refresh time is before the current expiry time.
-		ts, err := ptypes.Timestamp(in.Lock.Expires)
+		lock, err := decodeLockRow(row)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if ts.Before(expires) {
-			return ErrLockInvalidRefresh
+		// Locks are read in uuid order, so no further lock can match the prefix.
+		if !strings.HasPrefix(lock.Uuid, in.Prefix) {
+			break
 		}
 
-		return s.applyLock(txn, &pb.TryLockRequest{
-			Lock: in.Lock,
-		})
+		if len(resp.Locks) == limit {
+			resp.NextPageToken = resp.Locks[limit-1].Uuid
+			break
+		}
+		resp.Locks = append(resp.Locks, redactLock(lock))
+	}
+	return resp, nil
+}
 
-	}); err != nil {
+// History returns ErrAuditDisabled, as the events of locks are only recorded by an
+// Audit backend.
+func (s *Spanner) History(ctx context.Context, in *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	return nil, ErrAuditDisabled
+}
+
+// Watch streams the changes of a lock to its holder until it is lost.
+func (s *Spanner) Watch(in *pb.WatchRequest, stream pb.LockService_WatchServer) error {
+	return doWatch(s, in, stream, nil)
+}
+
+// Read returns the lock currently stored under uuid, whether or not it has expired.
+func (s *Spanner) Read(ctx context.Context, uuid string) (*pb.Lock, error) {
+	readLock, err := s.readLock(ctx, s.client.Single(), uuid)
+	switch {
+	case spanner.ErrCode(err) == codes.NotFound:
+		return nil, ErrLockNotFound
+	case err != nil:
 		return nil, err
 	}
-
-	return &pb.RefreshResponse{}, nil
+	return readLock, nil
 }
 
-// Release will release a lock that was previously acquired.
-func (s *Spanner) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+// Count adds delta to the counter stored under counter.Name and returns its updated
+// state. A counter that does not exist or has expired is first created from counter.
+func (s *Spanner) Count(ctx context.Context, counter *pb.Counter, delta int64) (*pb.Counter, error) {
+	stored := &pb.Counter{}
 	if _, err := s.client.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
-		row, err := txn.ReadRow(ctx, "Locks", spanner.Key{in.Lock.GetUuid()}, []string{"uuid", "owner", "expires"})
+		row, err := txn.ReadRow(ctx, "Counters", spanner.Key{counter.GetName()}, counterColumns)
 		switch {
 		case spanner.ErrCode(err) == codes.NotFound:
-			return nil
+			row = nil
 		case err != nil:
 			return err
 		}
 
-		// Lock found, read it.
-		readLock := pb.Lock{}
 		var expires time.Time
-		if err = row.Columns(&readLock.Uuid, &readLock.Owner, &expires); err != nil {
-			return err
+		if row != nil {
+			if err = row.Columns(&stored.Name, &stored.Target, &stored.Count, &expires); err != nil {
+				return err
+			}
 		}
 
-		if readLock.Owner != in.Lock.Owner {
-			return ErrLockInvalidOwner
+		// Start over from the requested counter if there is no live one.
+		if row == nil || time.Now().After(expires) {
+			if expires, err = ptypes.Timestamp(counter.Expires); err != nil {
+				return err
+			}
+			stored.Name = counter.Name
+			stored.Target = counter.Target
+			stored.Count = 0
+		} else if delta == 0 {
+			stored.Expires = timestamppb.New(expires)
+			return nil
 		}
-		m := spanner.Delete("Locks", spanner.Key{in.Lock.GetUuid()})
+
+		stored.Count += delta
+		stored.Expires = timestamppb.New(expires)
+		m := spanner.InsertOrUpdate("Counters", counterColumns, []interface{}{
+			stored.Name,
+			stored.Target,
+			stored.Count,
+			expires,
+		})
 		return txn.BufferWrite([]*spanner.Mutation{m})
 	}); err != nil {
 		return nil, err
 	}
-	return nil, nil
+
+	return stored, nil
+}
+
+// spannerAuditSink stores audit events in the AuditEvents table, where the events
+// of a lock are kept newest first.
+type spannerAuditSink struct {
+	client *spanner.Client
+}
+
+// AuditSink returns a sink storing audit events in the AuditEvents table of the
+// database. Closing the sink leaves the database open.
+func (s *Spanner) AuditSink() AuditSink {
+	return &spannerAuditSink{client: s.client}
+}
+
+func (a *spannerAuditSink) Write(ctx context.Context, event *pb.AuditEvent) error {
+	data, err := proto.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// Events recorded at the same time are told apart by a random id.
+	_, err = a.client.Apply(ctx, []*spanner.Mutation{spanner.Insert("AuditEvents", auditColumns, []interface{}{
+		event.Uuid,
+		event.Time.AsTime(),
+		uuid.New().String(),
+		event.Type.String(),
+		event.Owner,
+		event.Principal,
+		data,
+	})})
+	return err
+}
+
+func (a *spannerAuditSink) History(ctx context.Context, key string, limit int) ([]*pb.AuditEvent, error) {
+	iter := a.client.Single().ReadWithOptions(ctx, "AuditEvents", spanner.Key{key}.AsPrefix(), []string{"event"}, &spanner.ReadOptions{
+		Limit: limit,
+	})
+	defer iter.Stop()
+
+	var events []*pb.AuditEvent
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var data []byte
+		if err := row.Columns(&data); err != nil {
+			return nil, err
+		}
+		event := &pb.AuditEvent{}
+		if err := proto.Unmarshal(data, event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (a *spannerAuditSink) Close() error {
+	return nil
 }
@@ -3,15 +3,20 @@ package backends
 import (
 	"context"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/spanner"
 	"cloud.google.com/go/spanner/spannertest"
 	pb "github.com/gcp-services/lock/storage"
 	"github.com/spf13/viper"
 	"google.golang.org/api/option"
+	"google.golang.org/genproto/googleapis/spanner/admin/database/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-func setupSpanner() (pb.LockServiceServer, error) {
+func setupSpanner() (Backend, error) {
 	ctx := context.Background()
 
 	server, err := spannertest.NewServer(":9010")
@@ -37,11 +42,105 @@ func setupSpanner() (pb.LockServiceServer, error) {
 }
 
 func TestSpanner(t *testing.T) {
+	var sp *Spanner
 	testServer(t, &testBackend{
 		Name: "spanner",
 		Flags: map[string]interface{}{
 			"spanner.database": "projects/test/instances/test/databases/test",
 		},
-		Setup: setupSpanner,
+		Setup: func() (Backend, error) {
+			backend, err := setupSpanner()
+			if err != nil {
+				return nil, err
+			}
+			sp = backend.(*Spanner)
+			return sp, nil
+		},
 	})
+	testPurgeRequests(t, sp)
+}
+
+func testPurgeRequests(t *testing.T, sp *Spanner) {
+	ctx := context.Background()
+	for key, expires := range map[string]time.Time{
+		"expired": time.Now().Add(-time.Minute),
+		"live":    time.Now().Add(time.Minute),
+	} {
+		if _, err := sp.client.Apply(ctx, []*spanner.Mutation{
+			spanner.InsertOrUpdate("Requests", requestColumns, []interface{}{key, []byte{}, expires}),
+		}); err != nil {
+			t.Fatalf("error writing request: %v", err)
+		}
+	}
+
+	if _, err := sp.purgeExpiredRequests(ctx); err != nil {
+		t.Fatalf("error purging requests: %v", err)
+	}
+
+	if _, err := sp.client.Single().ReadRow(ctx, "Requests", spanner.Key{"expired"}, requestColumns); spanner.ErrCode(err) != codes.NotFound {
+		t.Fatalf("expected expired request to be purged, instead: %v", err)
+	}
+	if _, err := sp.client.Single().ReadRow(ctx, "Requests", spanner.Key{"live"}, requestColumns); err != nil {
+		t.Fatalf("expected live request to be kept, instead: %v", err)
+	}
+}
+
+func TestSpannerMigrateSchema(t *testing.T) {
+	ctx := context.Background()
+	server, err := spannertest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatalf("error starting spanner: %v", err)
+	}
+	defer server.Close()
+	conn, err := grpc.Dial(server.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("error connecting to spanner: %v", err)
+	}
+	sp, err := NewSpanner(ctx, "projects/test/instances/test/databases/migrated", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("error creating spanner backend: %v", err)
+	}
+	defer sp.Close()
+
+	// A database created by the first version only has the lock owner and expiry.
+	op, err := sp.admin.UpdateDatabaseDdl(ctx, &database.UpdateDatabaseDdlRequest{
+		Database: sp.databasePath,
+		Statements: []string{
+			`CREATE TABLE Locks (
+				uuid STRING(MAX) NOT NULL,
+				owner STRING(MAX) NOT NULL,
+				expires TIMESTAMP NOT NULL,
+				) PRIMARY KEY (uuid)`,
+		},
+	})
+	if err != nil {
+		t.Fatalf("error creating schema: %v", err)
+	}
+	if err := op.Wait(ctx); err != nil {
+		t.Fatalf("error creating schema: %v", err)
+	}
+	if _, err := sp.client.Apply(ctx, []*spanner.Mutation{
+		spanner.Insert("Locks", []string{"uuid", "owner", "expires"}, []interface{}{"old", "a", time.Now().Add(time.Minute)}),
+	}); err != nil {
+		t.Fatalf("error writing lock: %v", err)
+	}
+
+	if err := sp.MigrateSchema(ctx); err != nil {
+		t.Fatalf("error migrating schema: %v", err)
+	}
+	if statements, err := sp.migrations(ctx); err != nil || len(statements) != 0 {
+		t.Fatalf("expected the schema to be up to date, instead: %v %v", statements, err)
+	}
+
+	// Locks stored before the migration are read with the new columns.
+	lock, err := sp.Read(ctx, "old")
+	if err != nil {
+		t.Fatalf("error reading lock: %v", err)
+	}
+	if lock.Owner != "a" || lock.Holds != 1 {
+		t.Fatalf("unexpected lock: %v", lock)
+	}
+	if _, err := sp.Count(ctx, &pb.Counter{Name: "migrated", Target: 1, Expires: timestamppb.New(time.Now().Add(time.Minute))}, 1); err != nil {
+		t.Fatalf("error counting in a created table: %v", err)
+	}
 }
@@ -0,0 +1,77 @@
+package backends
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorCodes maps the errors of backends to the gRPC codes they are reported
+// with, and so to the HTTP statuses of the gateway.
+var errorCodes = []struct {
+	err  error
+	code codes.Code
+}{
+	{ErrLockBusy, codes.Aborted},
+	{ErrLockEtagMismatch, codes.Aborted},
+	{ErrDeadlock, codes.Aborted},
+	{ErrLockNotFound, codes.NotFound},
+	{ErrNoLeader, codes.NotFound},
+	{ErrLockInvalidOwner, codes.PermissionDenied},
+	{ErrLockExpired, codes.FailedPrecondition},
+	{ErrLockMaxHoldExceeded, codes.FailedPrecondition},
+	{ErrLockInvalidRefresh, codes.InvalidArgument},
+	{ErrPayloadTooLarge, codes.InvalidArgument},
+	{ErrLockDelayTooLong, codes.InvalidArgument},
+	{ErrLockReservedUuid, codes.InvalidArgument},
+	{ErrLockTTLTooLong, codes.InvalidArgument},
+	{ErrInvalidNamespace, codes.InvalidArgument},
+	{ErrInvalidCount, codes.InvalidArgument},
+	{ErrNamespaceFull, codes.ResourceExhausted},
+	{ErrQuotaExceeded, codes.ResourceExhausted},
+	{ErrBarrierTimeout, codes.DeadlineExceeded},
+	{ErrAuditDisabled, codes.Unimplemented},
+	{ErrHistoryUnsupported, codes.Unimplemented},
+	{context.DeadlineExceeded, codes.DeadlineExceeded},
+	{context.Canceled, codes.Canceled},
+}
+
+// Status returns err as a gRPC status. Errors of backends are given the code
+// matching their cause, and other errors without a status are unknown.
+func Status(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return status.Error(c.code, err.Error())
+		}
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// UnaryServerInterceptor returns the errors of requests as gRPC statuses, so that
+// clients receive the code matching their cause rather than an unknown status.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return nil, Status(err)
+		}
+		return resp, nil
+	}
+}
+
+// StreamServerInterceptor returns the errors ending streams as gRPC statuses, like
+// UnaryServerInterceptor.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := handler(srv, ss); err != nil {
+			return Status(err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,60 @@
+package backends
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	pb "github.com/gcp-services/lock/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// failingService fails every lock request with the errors of a backend.
+type failingService struct {
+	pb.UnimplementedLockServiceServer
+}
+
+func (s *failingService) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	return nil, ErrLockBusy
+}
+
+func (s *failingService) Watch(in *pb.WatchRequest, stream pb.LockService_WatchServer) error {
+	return ErrLockNotFound
+}
+
+func TestStatusInterceptors(t *testing.T) {
+	l := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor()),
+		grpc.StreamInterceptor(StreamServerInterceptor()),
+	)
+	pb.RegisterLockServiceServer(s, &failingService{})
+	go s.Serve(l)
+	defer s.Stop()
+
+	ctx := context.Background()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return l.Dial()
+	}))
+	if err != nil {
+		t.Fatalf("error dialing server: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewLockServiceClient(conn)
+
+	// Clients receive the code matching the error of the backend.
+	if _, err := client.TryLock(ctx, &pb.TryLockRequest{}); status.Code(err) != codes.Aborted {
+		t.Fatalf("expected aborted status, instead: %v", err)
+	}
+
+	stream, err := client.Watch(ctx, &pb.WatchRequest{})
+	if err != nil {
+		t.Fatalf("error watching: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found status, instead: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package backends
+
+import (
+	"context"
+
+	pb "github.com/gcp-services/lock/storage"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+)
+
+// instrumentationName names the tracer creating the spans of this package.
+const instrumentationName = "github.com/gcp-services/lock/backends"
+
+// startSpan starts a span named name for an operation on lock. Spans are recorded
+// by the tracer provider installed with global.SetTracerProvider, if any.
+func startSpan(ctx context.Context, name string, lock *pb.Lock, attrs ...label.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		label.String("lock.uuid", lock.GetUuid()),
+		label.String("lock.owner", lock.GetOwner()),
+	)
+	return global.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the outcome of the operation traced by span, and ends it.
+// Busy locks are an expected outcome and are not recorded as errors.
+func endSpan(ctx context.Context, span trace.Span, err error, success string) {
+	o := outcome(err, success)
+	span.SetAttributes(label.String("lock.outcome", o))
+	if o == outcomeError || o == outcomeInvalidOwner {
+		span.RecordError(ctx, err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Traced returns a backend recording a span for every call made to next, which is
+// labelled with name.
+func Traced(name string, next Backend) Backend {
+	return &tracedBackend{next: next, backend: label.String("lock.backend", name)}
+}
+
+// tracedBackend traces the calls made to a backend.
+type tracedBackend struct {
+	next    Backend
+	backend label.KeyValue
+}
+
+func (b *tracedBackend) TryLock(ctx context.Context, in *pb.TryLockRequest) (resp *pb.TryLockResponse, err error) {
+	ctx, span := startSpan(ctx, "Backend.TryLock", in.Lock, b.backend)
+	defer func() { endSpan(ctx, span, err, outcomeAcquired) }()
+	return b.next.TryLock(ctx, in)
+}
+
+func (b *tracedBackend) Lock(ctx context.Context, in *pb.LockRequest) (resp *pb.LockResponse, err error) {
+	ctx, span := startSpan(ctx, "Backend.Lock", in.Lock, b.backend)
+	defer func() { endSpan(ctx, span, err, outcomeAcquired) }()
+	return b.next.Lock(ctx, in)
+}
+
+func (b *tracedBackend) Refresh(ctx context.Context, in *pb.RefreshRequest) (resp *pb.RefreshResponse, err error) {
+	ctx, span := startSpan(ctx, "Backend.Refresh", in.Lock, b.backend)
+	defer func() { endSpan(ctx, span, err, outcomeOK) }()
+	return b.next.Refresh(ctx, in)
+}
+
+func (b *tracedBackend) Transfer(ctx context.Context, in *pb.TransferRequest) (resp *pb.TransferResponse, err error) {
+	ctx, span := startSpan(ctx, "Backend.Transfer", in.Lock, b.backend, label.String("lock.new_owner", in.NewOwner))
+	defer func() { endSpan(ctx, span, err, outcomeOK) }()
+	return b.next.Transfer(ctx, in)
+}
+
+func (b *tracedBackend) Release(ctx context.Context, in *pb.ReleaseRequest) (resp *pb.ReleaseResponse, err error) {
+	ctx, span := startSpan(ctx, "Backend.Release", in.Lock, b.backend)
+	defer func() { endSpan(ctx, span, err, outcomeOK) }()
+	return b.next.Release(ctx, in)
+}
+
+func (b *tracedBackend) Describe(ctx context.Context, in *pb.DescribeRequest) (resp *pb.DescribeResponse, err error) {
+	ctx, span := startSpan(ctx, "Backend.Describe", &pb.Lock{Uuid: in.Uuid}, b.backend)
+	defer func() { endSpan(ctx, span, err, outcomeOK) }()
+	return b.next.Describe(ctx, in)
+}
+
+func (b *tracedBackend) List(ctx context.Context, in *pb.ListRequest) (resp *pb.ListResponse, err error) {
+	ctx, span := global.Tracer(instrumentationName).Start(ctx, "Backend.List",
+		trace.WithAttributes(b.backend, label.String("lock.prefix", in.Prefix)))
+	defer func() { endSpan(ctx, span, err, outcomeOK) }()
+	return b.next.List(ctx, in)
+}
+
+func (b *tracedBackend) Put(ctx context.Context, in *pb.PutRequest) (resp *pb.PutResponse, err error) {
+	ctx, span := startSpan(ctx, "Backend.Put", in.Lock, b.backend)
+	defer func() { endSpan(ctx, span, err, outcomeOK) }()
+	return b.next.Put(ctx, in)
+}
+
+func (b *tracedBackend) Get(ctx context.Context, in *pb.GetRequest) (resp *pb.GetResponse, err error) {
+	ctx, span := startSpan(ctx, "Backend.Get", &pb.Lock{Uuid: in.Uuid}, b.backend)
+	defer func() { endSpan(ctx, span, err, outcomeOK) }()
+	return b.next.Get(ctx, in)
+}
+
+func (b *tracedBackend) History(ctx context.Context, in *pb.HistoryRequest) (resp *pb.HistoryResponse, err error) {
+	ctx, span := startSpan(ctx, "Backend.History", &pb.Lock{Uuid: in.Uuid}, b.backend)
+	defer func() { endSpan(ctx, span, err, outcomeOK) }()
+	return b.next.History(ctx, in)
+}
+
+// Watch polls the lock through the traced backend, so that every read is traced.
+func (b *tracedBackend) Watch(in *pb.WatchRequest, stream pb.LockService_WatchServer) error {
+	return doWatch(b, in, stream, nil)
+}
+
+func (b *tracedBackend) Read(ctx context.Context, uuid string) (lock *pb.Lock, err error) {
+	ctx, span := startSpan(ctx, "Backend.Read", &pb.Lock{Uuid: uuid}, b.backend)
+	defer func() { endSpan(ctx, span, err, outcomeOK) }()
+	return b.next.Read(ctx, uuid)
+}
+
+func (b *tracedBackend) Count(ctx context.Context, counter *pb.Counter, delta int64) (resp *pb.Counter, err error) {
+	ctx, span := global.Tracer(instrumentationName).Start(ctx, "Backend.Count",
+		trace.WithAttributes(b.backend, label.String("counter.name", counter.Name), label.Int64("counter.delta", delta)))
+	defer func() { endSpan(ctx, span, err, outcomeOK) }()
+	return b.next.Count(ctx, counter, delta)
+}
+
+func (b *tracedBackend) Close() error {
+	return b.next.Close()
+}
@@ -0,0 +1,99 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/gcp-services/lock/storage"
+	"go.opentelemetry.io/otel/api/global"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// recordedSpans records the spans that have ended.
+type recordedSpans struct {
+	mu    sync.Mutex
+	spans []*export.SpanData
+}
+
+func (r *recordedSpans) OnStart(sd *export.SpanData) {}
+func (r *recordedSpans) Shutdown()                   {}
+func (r *recordedSpans) ForceFlush()                 {}
+
+func (r *recordedSpans) OnEnd(sd *export.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, sd)
+}
+
+// named returns the attributes of the recorded spans named name.
+func (r *recordedSpans) named(name string) []map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var named []map[string]string
+	for _, sd := range r.spans {
+		if sd.Name != name {
+			continue
+		}
+		attrs := make(map[string]string)
+		for _, kv := range sd.Attributes {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+		}
+		named = append(named, attrs)
+	}
+	return named
+}
+
+func testTracing(t *testing.T, backend Backend) {
+	ctx := context.Background()
+	recorded := &recordedSpans{}
+	global.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithSpanProcessor(recorded),
+	))
+	db := Traced("test", backend)
+	expires := timestamppb.New(time.Now().Add(time.Minute))
+
+	if _, err := db.TryLock(ctx, &pb.TryLockRequest{
+		Lock: &pb.Lock{Uuid: "traced", Owner: "1234", Expires: expires},
+	}); err != nil {
+		t.Fatalf("error trying to lock: %v", err)
+	}
+
+	if _, err := db.Lock(ctx, &pb.LockRequest{
+		Lock:    &pb.Lock{Uuid: "traced", Owner: "5678", Expires: expires},
+		Timeout: durationpb.New(time.Millisecond * 100),
+	}); err != ErrLockBusy {
+		t.Fatalf("expected lock to fail with busy, instead: %v", err)
+	}
+
+	tried := recorded.named("Backend.TryLock")
+	if len(tried) != 1 || tried[0]["lock.backend"] != "test" || tried[0]["lock.uuid"] != "traced" || tried[0]["lock.outcome"] != outcomeAcquired {
+		t.Fatalf("unexpected TryLock spans: %v", tried)
+	}
+
+	// Every attempt of the blocking Lock call is traced.
+	attempts := recorded.named("TryLock attempt")
+	if len(attempts) < 2 {
+		t.Fatalf("expected at least two attempts to be traced, instead: %v", attempts)
+	}
+	for i, attempt := range attempts {
+		if attempt["lock.owner"] != "5678" || attempt["lock.outcome"] != outcomeBusy {
+			t.Fatalf("unexpected attempt span: %v", attempt)
+		}
+		if attempt["lock.attempt"] != fmt.Sprint(i+1) {
+			t.Fatalf("expected attempt %d, instead: %v", i+1, attempt)
+		}
+	}
+
+	locked := recorded.named("Backend.Lock")
+	if len(locked) != 1 || locked[0]["lock.outcome"] != outcomeBusy {
+		t.Fatalf("unexpected Lock spans: %v", locked)
+	}
+}
@@ -2,6 +2,9 @@ package backends
 
 import (
 	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -13,4 +16,41 @@ var (
 	ErrLockInvalidRefresh = fmt.Errorf("lock can not be refreshed to a duration shorter than the current duration")
 	// ErrLockNotFound denotes an attempt to refresh a lock that was not found.
 	ErrLockNotFound = fmt.Errorf("lock not found")
+	// ErrLockExpired denotes an attempt to transfer a lock that has already expired.
+	ErrLockExpired = fmt.Errorf("lock has expired")
+	// ErrLockEtagMismatch denotes a request expecting an etag that the stored lock no longer has.
+	ErrLockEtagMismatch = fmt.Errorf("lock etag does not match")
+	// ErrShuttingDown denotes a blocking call abandoned because the server is shutting
+	// down. It is returned as an unavailable status, so that callers retry it against
+	// another server.
+	ErrShuttingDown = status.Error(codes.Unavailable, "server is shutting down")
+	// ErrDeadlock denotes a blocking lock call that would wait on its own locks.
+	ErrDeadlock = fmt.Errorf("deadlock detected")
+	// ErrPayloadTooLarge denotes a lock with a payload larger than the stored payload limit.
+	ErrPayloadTooLarge = fmt.Errorf("lock payload is too large")
+	// ErrLockDelayTooLong denotes a lock requested with a lock-delay longer than allowed.
+	ErrLockDelayTooLong = fmt.Errorf("lock delay is too long")
+	// ErrLockReservedUuid denotes a lock of the default namespace with a uuid reserved for named namespaces,
+	// elections, barriers or latches.
+	ErrLockReservedUuid = fmt.Errorf("lock uuid uses a reserved prefix")
+	// ErrLockTTLTooLong denotes a lock requested with a longer time to live than its namespace allows.
+	ErrLockTTLTooLong = fmt.Errorf("lock expiry exceeds the maximum ttl of its namespace")
+	// ErrLockMaxHoldExceeded denotes a lock held for longer than its namespace allows.
+	ErrLockMaxHoldExceeded = fmt.Errorf("lock has been held for the maximum hold time of its namespace")
+	// ErrInvalidNamespace denotes a namespace with an invalid name.
+	ErrInvalidNamespace = fmt.Errorf("invalid namespace name")
+	// ErrNamespaceFull denotes a namespace that already holds its maximum number of locks.
+	ErrNamespaceFull = fmt.Errorf("namespace holds the maximum number of locks")
+	// ErrQuotaExceeded denotes a request that exceeded a quota of its namespace or owner.
+	ErrQuotaExceeded = fmt.Errorf("quota exceeded")
+	// ErrNoLeader denotes an election that currently has no leader.
+	ErrNoLeader = fmt.Errorf("election has no leader")
+	// ErrBarrierTimeout denotes a barrier or latch that was not released before the timeout.
+	ErrBarrierTimeout = fmt.Errorf("barrier was not released before the timeout")
+	// ErrInvalidCount denotes a barrier or latch created with a count below one.
+	ErrInvalidCount = fmt.Errorf("count must be greater than zero")
+	// ErrAuditDisabled denotes a request for the history of a lock from a server without an audit log.
+	ErrAuditDisabled = fmt.Errorf("audit log is not enabled")
+	// ErrHistoryUnsupported denotes a request for the history of a lock from an audit sink that can't be read.
+	ErrHistoryUnsupported = fmt.Errorf("audit sink does not support history queries")
 )
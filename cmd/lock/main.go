@@ -2,21 +2,47 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/gcp-services/lock/auth"
 	"github.com/gcp-services/lock/backends"
+	"github.com/gcp-services/lock/gateway"
+	"github.com/gcp-services/lock/logging"
 	pb "github.com/gcp-services/lock/storage"
-	"github.com/golang/protobuf/ptypes"
+	"github.com/gcp-services/lock/tlsconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/propagators"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 type service struct {
-	db pb.LockServiceServer
+	db    backends.Backend
+	waits *backends.WaitGraph
 }
 
 func (s *service) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
@@ -24,58 +50,51 @@ func (s *service) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLo
 }
 
 func (s *service) Lock(ctx context.Context, in *pb.LockRequest) (*pb.LockResponse, error) {
-	start := time.Now()
-	req := &pb.TryLockRequest{
-		Lock: in.Lock,
-	}
+	return s.waits.Lock(ctx, s.db, in)
+}
 
-	_, err := s.db.TryLock(ctx, req)
+func (s *service) Refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	return s.db.Refresh(ctx, in)
+}
 
-	switch err {
-	case backends.ErrLockBusy:
-		break
-	case nil:
-		// TODO(lobato): craft a response here.
-		return &pb.LockResponse{}, nil
-	}
+func (s *service) Transfer(ctx context.Context, in *pb.TransferRequest) (*pb.TransferResponse, error) {
+	return s.db.Transfer(ctx, in)
+}
 
-	dur, err := ptypes.Duration(in.Timeout)
-	if err != nil {
-		return nil, err
-	}
+func (s *service) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	return s.db.Release(ctx, in)
+}
 
-	for {
-		// Check if the maximum wait duration has expired.
-		if time.Now().After(start.Add(dur)) {
-			return nil, backends.ErrLockBusy
-		}
+func (s *service) Describe(ctx context.Context, in *pb.DescribeRequest) (*pb.DescribeResponse, error) {
+	return s.db.Describe(ctx, in)
+}
 
-		_, err := s.db.TryLock(ctx, req)
+func (s *service) List(ctx context.Context, in *pb.ListRequest) (*pb.ListResponse, error) {
+	return s.db.List(ctx, in)
+}
 
-		switch err {
-		case backends.ErrLockBusy:
-			break
-		case nil:
-			return &pb.LockResponse{}, nil
-		default:
-			return nil, err
-		}
+func (s *service) Put(ctx context.Context, in *pb.PutRequest) (*pb.PutResponse, error) {
+	return s.db.Put(ctx, in)
+}
 
-		time.Sleep(time.Second)
-	}
+func (s *service) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	return s.db.Get(ctx, in)
 }
 
-func (s *service) Refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
-	return s.db.Refresh(ctx, in)
+func (s *service) History(ctx context.Context, in *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	return s.db.History(ctx, in)
 }
 
-func (s *service) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
-	return s.db.Release(ctx, in)
+func (s *service) Watch(in *pb.WatchRequest, stream pb.LockService_WatchServer) error {
+	return s.waits.Watch(s.db, in, stream)
 }
 
-func createService() (*service, error) {
-	var svc service
+func createService(metrics *backends.Metrics) (*service, error) {
+	svc := service{
+		waits: backends.NewWaitGraph(),
+	}
 
+	var sp *backends.Spanner
 	switch viper.GetString("backend") {
 	case "spanner":
 		path := viper.GetString("spanner.database")
@@ -83,28 +102,96 @@ func createService() (*service, error) {
 			return nil, fmt.Errorf("no spanner database path specified")
 		}
 
-		sp, err := backends.NewSpanner(context.Background(), path)
+		var err error
+		sp, err = backends.NewSpanner(context.Background(), path)
 
 		if err != nil {
 			return nil, fmt.Errorf("failed to create spanner backend: %v", err)
 		}
-		svc.db = sp
+		if viper.GetBool("spanner.migrate") {
+			if err := sp.MigrateSchema(context.Background()); err != nil {
+				return nil, fmt.Errorf("failed to migrate spanner schema: %v", err)
+			}
+		}
+		svc.db = metrics.Backend("spanner", backends.Traced("spanner", sp))
 	default:
 		return nil, fmt.Errorf("backend not specified or invalid")
 	}
 
+	sink, err := auditSink(sp)
+	if err != nil {
+		return nil, err
+	}
+	if sink != nil {
+		svc.db = backends.NewAudit(svc.db, sink)
+	}
+
 	return &svc, nil
 }
 
+// auditSink returns the configured audit sink, or nil if the audit log is
+// disabled. The spanner sink stores events in the database of the spanner backend,
+// sp.
+func auditSink(sp *backends.Spanner) (backends.AuditSink, error) {
+	switch viper.GetString("audit.sink") {
+	case "":
+		return nil, nil
+	case "stdout":
+		return backends.NewWriterAuditSink(os.Stdout), nil
+	case "file":
+		path := viper.GetString("audit.file.path")
+		if path == "" {
+			return nil, fmt.Errorf("no audit file path specified")
+		}
+		sink, err := backends.NewFileAuditSink(path, viper.GetInt64("audit.file.max_size"), viper.GetInt("audit.file.max_backups"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit file: %v", err)
+		}
+		return sink, nil
+	case "spanner":
+		if sp == nil {
+			return nil, fmt.Errorf("the spanner audit sink requires the spanner backend")
+		}
+		return sp.AuditSink(), nil
+	}
+	return nil, fmt.Errorf("invalid audit sink %q", viper.GetString("audit.sink"))
+}
+
 func config() error {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
 
 	pflag.Int("port", 9876, "listen port for gRPC connections")
+	pflag.String("log.level", "info", "minimum level of the entries logged: debug, info, warn or error")
+	pflag.String("log.format", "json", "encoding of log entries: json or text")
+	pflag.Int("log.sample_initial", 100, "entries with the same level and message logged every second before sampling, or 0 to disable sampling")
+	pflag.Int("log.sample_thereafter", 100, "rate of the entries logged once sampling has started")
+	pflag.Int("metrics.port", 9877, "listen port for the Prometheus metrics endpoint, or 0 to disable it")
+	pflag.Int("gateway.port", 0, "listen port for the HTTP/JSON gateway to the lock service, or 0 to disable it")
 	pflag.String("backend", "", "backend to use for locking")
 	pflag.String("spanner.database", "", "spanner database path to use")
+	pflag.Bool("spanner.migrate", false, "add the tables and columns missing from the spanner database at startup")
 	pflag.String("bigtable.table", "", "bigtable table to use for locks")
+	pflag.String("tls.cert", "", "certificate file presented to clients, serving TLS if set")
+	pflag.String("tls.key", "", "key file of the TLS certificate")
+	pflag.String("tls.client_ca", "", "CA certificates file that client certificates must be signed by, requiring mutual TLS if set")
+	pflag.Duration("shutdown.timeout", time.Second*30, "time given to requests to complete on shutdown before they are cancelled")
+	pflag.Duration("health.interval", time.Second*10, "interval between probes of the backend reported by health checks")
+	pflag.String("tracing.exporter", "", "exporter of trace spans: otlp, stdout, or none if empty")
+	pflag.String("tracing.otlp.address", "localhost:55680", "address of the OTLP collector to export spans to")
+	pflag.Bool("tracing.otlp.insecure", false, "export spans to the OTLP collector without TLS")
+	pflag.Float64("tracing.sample_ratio", 1, "fraction of the traces started by the server that are sampled")
+	pflag.Bool("auth.mtls", false, "authenticate clients by the common name of their certificate, requiring tls.client_ca")
+	pflag.String("auth.jwt.jwks", "", "JWKS file of the keys signing the bearer tokens of clients, authenticating them by subject if set")
+	pflag.String("auth.jwt.issuer", "", "issuer of the bearer tokens of clients, required with auth.jwt.jwks")
+	pflag.String("auth.jwt.audience", "", "audience of the bearer tokens of clients, required with auth.jwt.jwks")
+	pflag.String("auth.owner", "", "binding of lock owners to authenticated principals: match, derive, or none if empty")
+	pflag.String("auth.policy", "", "policy file of the operations granted to every principal, authorizing requests if set")
+	pflag.String("audit.sink", "", "sink of the audit log of lock events: stdout, file, spanner, or none if empty")
+	pflag.String("audit.file.path", "audit.log", "file the audit log is appended to by the file sink")
+	pflag.Int64("audit.file.max_size", 100<<20, "size in bytes the audit file is rotated at, or 0 to never rotate it")
+	pflag.Int("audit.file.max_backups", 5, "number of rotated audit files kept")
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
 
@@ -119,29 +206,315 @@ func config() error {
 	return nil
 }
 
+// tracing installs the tracer provider exporting spans with the configured
+// exporter. The returned function flushes the remaining spans.
+func tracing() (func(), error) {
+	var exporter export.SpanExporter
+	switch viper.GetString("tracing.exporter") {
+	case "":
+		return func() {}, nil
+	case "otlp":
+		opts := []otlp.ExporterOption{otlp.WithAddress(viper.GetString("tracing.otlp.address"))}
+		if viper.GetBool("tracing.otlp.insecure") {
+			opts = append(opts, otlp.WithInsecure())
+		}
+		exp, err := otlp.NewExporter(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlp exporter: %v", err)
+		}
+		exporter = exp
+	case "stdout":
+		exp, err := stdout.NewExporter(stdout.WithPrettyPrint(), stdout.WithoutMetricExport())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout exporter: %v", err)
+		}
+		exporter = exp
+	default:
+		return nil, fmt.Errorf("invalid tracing exporter %q", viper.GetString("tracing.exporter"))
+	}
+
+	spans := sdktrace.NewBatchSpanProcessor(exporter)
+	global.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithConfig(sdktrace.Config{
+			DefaultSampler: sdktrace.ParentBased(sdktrace.TraceIDRatioBased(viper.GetFloat64("tracing.sample_ratio"))),
+		}),
+		sdktrace.WithResource(resource.New(label.String("service.name", "lock"))),
+		sdktrace.WithSpanProcessor(spans),
+	))
+	global.SetTextMapPropagator(otel.NewCompositeTextMapPropagator(propagators.TraceContext{}, propagators.Baggage{}))
+
+	return func() {
+		spans.Shutdown()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := exporter.Shutdown(ctx); err != nil {
+			zap.L().Error("error shutting down trace exporter", zap.Error(err))
+		}
+	}, nil
+}
+
+// apiKey is the static API key of a principal.
+type apiKey struct {
+	Principal string `mapstructure:"principal"`
+	Key       string `mapstructure:"key"`
+}
+
+// authentication returns the interceptors authenticating and authorizing requests
+// with the configured authenticators and policy, or none if authentication isn't
+// configured.
+func authentication() ([]grpc.UnaryServerInterceptor, []grpc.StreamServerInterceptor, error) {
+	var authenticators []auth.Authenticator
+	if viper.GetBool("auth.mtls") {
+		if viper.GetString("tls.client_ca") == "" {
+			return nil, nil, fmt.Errorf("auth.mtls requires tls.client_ca to be set")
+		}
+		authenticators = append(authenticators, auth.MTLS{})
+	}
+
+	// API keys are listed rather than keyed by principal, as viper lowercases the
+	// keys of maps and principals are case sensitive.
+	var apiKeys []apiKey
+	if err := viper.UnmarshalKey("auth.api_keys", &apiKeys); err != nil {
+		return nil, nil, fmt.Errorf("failed to read api keys: %v", err)
+	}
+	if len(apiKeys) > 0 {
+		keys := make(map[string]string, len(apiKeys))
+		for _, k := range apiKeys {
+			keys[k.Principal] = k.Key
+		}
+		authenticators = append(authenticators, auth.NewAPIKeys(keys))
+	}
+
+	if jwks := viper.GetString("auth.jwt.jwks"); jwks != "" {
+		if viper.GetString("auth.jwt.issuer") == "" || viper.GetString("auth.jwt.audience") == "" {
+			return nil, nil, fmt.Errorf("auth.jwt.jwks requires auth.jwt.issuer and auth.jwt.audience to be configured")
+		}
+		a, err := auth.NewJWT(jwks, viper.GetString("auth.jwt.issuer"), viper.GetString("auth.jwt.audience"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to configure jwt authentication: %v", err)
+		}
+		authenticators = append(authenticators, a)
+	}
+
+	var policy *auth.Policy
+	if file := viper.GetString("auth.policy"); file != "" {
+		p, err := auth.LoadPolicy(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		policy = p
+	}
+
+	if len(authenticators) == 0 {
+		if policy != nil {
+			return nil, nil, fmt.Errorf("auth.policy requires an authentication method to be configured")
+		}
+		return nil, nil, nil
+	}
+	return []grpc.UnaryServerInterceptor{auth.UnaryServerInterceptor(authenticators, policy)},
+		[]grpc.StreamServerInterceptor{auth.StreamServerInterceptor(authenticators, policy)},
+		nil
+}
+
 func main() {
 
 	if err := config(); err != nil {
 		log.Fatalf("error reading config: %v", err)
 	}
 
+	logger, err := logging.New(logging.Config{
+		Level:            viper.GetString("log.level"),
+		Format:           viper.GetString("log.format"),
+		SampleInitial:    viper.GetInt("log.sample_initial"),
+		SampleThereafter: viper.GetInt("log.sample_thereafter"),
+	})
+	if err != nil {
+		log.Fatalf("error creating logger: %v", err)
+	}
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", viper.GetInt("port")))
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		logger.Fatal("failed to listen", zap.Error(err))
+	}
+
+	flush, err := tracing()
+	if err != nil {
+		logger.Fatal("error setting up tracing", zap.Error(err))
+	}
+	defer flush()
+
+	// Requests are traced and logged before they are authenticated, so that
+	// rejected requests are traced and logged too. Their errors are converted to
+	// statuses before being traced, logged and returned.
+	unary, stream, err := authentication()
+	if err != nil {
+		logger.Fatal("error configuring authentication", zap.Error(err))
+	}
+	requests := logger.With(zap.String("backend", viper.GetString("backend")))
+	unary = append([]grpc.UnaryServerInterceptor{otelgrpc.UnaryServerInterceptor(), logging.UnaryServerInterceptor(requests), backends.UnaryServerInterceptor()}, unary...)
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(append([]grpc.StreamServerInterceptor{otelgrpc.StreamServerInterceptor(), logging.StreamServerInterceptor(requests), backends.StreamServerInterceptor()}, stream...)...),
+	}
+
+	// Certificates are reloaded from disk whenever they change.
+	var tlsConfig *tls.Config
+	if cert := viper.GetString("tls.cert"); cert != "" {
+		tlsConfig, err = tlsconfig.ServerConfig(cert, viper.GetString("tls.key"), viper.GetString("tls.client_ca"))
+		if err != nil {
+			logger.Fatal("error configuring tls", zap.Error(err))
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if viper.GetString("tls.client_ca") != "" {
+		logger.Fatal("tls.client_ca requires tls.cert and tls.key to be set")
+	}
+
+	s := grpc.NewServer(opts...)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	metrics, err := backends.NewMetrics(registry)
+	if err != nil {
+		logger.Fatal("error registering metrics", zap.Error(err))
 	}
 
-	s := grpc.NewServer()
+	svc, err := createService(metrics)
+	if err != nil {
+		logger.Fatal("error creating service", zap.Error(err))
+	}
 
-	svc, err := createService()
+	var namespaces map[string]*backends.NamespaceConfig
+	if err := viper.UnmarshalKey("namespaces", &namespaces); err != nil {
+		logger.Fatal("error reading namespaces", zap.Error(err))
+	}
+
+	// The default namespace has no name, so it is configured separately.
+	if viper.IsSet("default_namespace") {
+		config := &backends.NamespaceConfig{}
+		if err := viper.UnmarshalKey("default_namespace", config); err != nil {
+			logger.Fatal("error reading default namespace", zap.Error(err))
+		}
+		if namespaces == nil {
+			namespaces = make(map[string]*backends.NamespaceConfig)
+		}
+		namespaces[""] = config
+	}
+
+	owners, err := auth.ParseOwnerMode(viper.GetString("auth.owner"))
 	if err != nil {
-		log.Fatalf("error creating service: %v", err)
+		logger.Fatal("error configuring authentication", zap.Error(err))
+	}
+	if owners != auth.OwnerUnbound && len(stream) == 0 {
+		logger.Fatal("auth.owner requires an authentication method to be configured")
 	}
 
-	pb.RegisterLockServiceServer(s, svc)
+	lockService := metrics.Service(auth.BindOwners(backends.NewNamespaces(svc, namespaces), owners))
+	pb.RegisterLockServiceServer(s, lockService)
+	// Elections acquire their locks through the lock service, so that clients of
+	// the lock service can't reach them and they are bound by the same checks.
+	locks := backends.ServiceBackend(lockService, svc.db)
+	election := backends.NewElection(locks)
+	barrier := backends.NewBarrier(locks)
+	pb.RegisterElectionServiceServer(s, auth.BindCandidates(election, owners))
+	pb.RegisterBarrierServiceServer(s, barrier)
+
+	// Services are reported as serving once the backend has been reached.
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(s, healthServer)
+	ctx, stop := context.WithCancel(context.Background())
+	go backends.NewHealth(svc.db, healthServer, viper.GetDuration("health.interval")).Run(ctx)
 
-	log.Printf("starting server on port %d", viper.GetInt("port"))
+	reflection.Register(s)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	metricsServer := &http.Server{Addr: fmt.Sprintf(":%d", viper.GetInt("metrics.port")), Handler: mux}
+	if port := viper.GetInt("metrics.port"); port != 0 {
+		go func() {
+			logger.Info("serving metrics", zap.Int("port", port))
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatal("failed to serve metrics", zap.Error(err))
+			}
+		}()
+	}
+
+	// The gateway serves the lock service as HTTP/JSON, with the same TLS
+	// configuration and interceptors as the gRPC server.
+	gatewayHandler, err := gateway.NewHandler(ctx, lockService, unary...)
+	if err != nil {
+		logger.Fatal("error creating gateway", zap.Error(err))
+	}
+	gatewayServer := &http.Server{Addr: fmt.Sprintf(":%d", viper.GetInt("gateway.port")), Handler: gatewayHandler, TLSConfig: tlsConfig}
+	if port := viper.GetInt("gateway.port"); port != 0 {
+		go func() {
+			logger.Info("serving gateway", zap.Int("port", port))
+			var err error
+			if tlsConfig != nil {
+				err = gatewayServer.ListenAndServeTLS("", "")
+			} else {
+				err = gatewayServer.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				logger.Fatal("failed to serve gateway", zap.Error(err))
+			}
+		}()
+	}
+
+	// Stop gracefully on SIGTERM or SIGINT. The server is reported as not serving,
+	// waiting Lock, Campaign, Enter and Await calls and Watch and Observe streams
+	// fail with an unavailable status so their callers retry against another
+	// server, and the remaining requests are completed, those of the gateway
+	// first, before the backend is closed. Requests still running after the
+	// shutdown timeout are cancelled.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		logger.Info("shutting down", zap.Stringer("signal", sig))
+		stop()
+		healthServer.Shutdown()
+		svc.waits.Close()
+		election.Close()
+		barrier.Close()
+
+		// The gateway calls the lock service directly, so its requests are
+		// completed before the gRPC server stops.
+		deadline := time.Now().Add(viper.GetDuration("shutdown.timeout"))
+		gatewayCtx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := gatewayServer.Shutdown(gatewayCtx); err != nil {
+			logger.Warn("cancelling gateway requests still running after the shutdown timeout", zap.Error(err))
+			gatewayServer.Close()
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			s.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Until(deadline)):
+			logger.Warn("cancelling requests still running after the shutdown timeout")
+			s.Stop()
+		}
+	}()
+
+	logger.Info("starting server", zap.Int("port", viper.GetInt("port")))
 	if err := s.Serve(l); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+		logger.Fatal("failed to serve", zap.Error(err))
 	}
 
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+		logger.Error("error shutting down metrics server", zap.Error(err))
+	}
+	if err := svc.db.Close(); err != nil {
+		logger.Error("error closing backend", zap.Error(err))
+	}
+	logger.Info("server stopped")
 }
@@ -0,0 +1,187 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/textproto"
+
+	"github.com/gcp-services/lock/backends"
+	pb "github.com/gcp-services/lock/storage"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// forwardedHeaders lists the headers passed to the lock service as metadata, in
+// addition to the authorization header.
+var forwardedHeaders = map[string]bool{
+	"X-Api-Key": true,
+}
+
+// headerMatcher forwards the headers carrying credentials under their own name.
+func headerMatcher(key string) (string, bool) {
+	if forwardedHeaders[textproto.CanonicalMIMEHeaderKey(key)] {
+		return key, true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// errorHandler writes the HTTP status matching err.
+func errorHandler(ctx context.Context, mux *runtime.ServeMux, marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	runtime.DefaultHTTPProtoErrorHandler(ctx, mux, marshaler, w, r, backends.Status(err))
+}
+
+// NewHandler returns an HTTP handler serving the lock service server as JSON.
+// Requests are passed through interceptors, in order, like the requests of the
+// gRPC server, so that they are traced and authenticated the same way.
+func NewHandler(ctx context.Context, server pb.LockServiceServer, interceptors ...grpc.UnaryServerInterceptor) (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(headerMatcher),
+		runtime.WithProtoErrorHandler(errorHandler),
+	)
+	if err := pb.RegisterLockServiceHandlerServer(ctx, mux, &interceptedService{next: server, interceptors: interceptors}); err != nil {
+		return nil, err
+	}
+
+	// Requests carry the address and certificate of their client, as if they were
+	// made over gRPC.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := &peer.Peer{Addr: remoteAddr(r.RemoteAddr)}
+		if r.TLS != nil {
+			p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+		}
+		mux.ServeHTTP(w, r.WithContext(peer.NewContext(r.Context(), p)))
+	}), nil
+}
+
+// remoteAddr is the address of the client of an HTTP request.
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
+
+// interceptedService passes the requests of a lock service through gRPC
+// interceptors.
+type interceptedService struct {
+	next         pb.LockServiceServer
+	interceptors []grpc.UnaryServerInterceptor
+}
+
+// call passes req through the interceptors before handling it with handler, as
+// the method named method.
+func (s *interceptedService) call(ctx context.Context, method string, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	info := &grpc.UnaryServerInfo{Server: s.next, FullMethod: "/storage.LockService/" + method}
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := s.interceptors[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler(ctx, req)
+}
+
+func (s *interceptedService) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	resp, err := s.call(ctx, "TryLock", in, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.next.TryLock(ctx, req.(*pb.TryLockRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.TryLockResponse), nil
+}
+
+func (s *interceptedService) Lock(ctx context.Context, in *pb.LockRequest) (*pb.LockResponse, error) {
+	resp, err := s.call(ctx, "Lock", in, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.next.Lock(ctx, req.(*pb.LockRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.LockResponse), nil
+}
+
+func (s *interceptedService) Refresh(ctx context.Context, in *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	resp, err := s.call(ctx, "Refresh", in, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.next.Refresh(ctx, req.(*pb.RefreshRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.RefreshResponse), nil
+}
+
+func (s *interceptedService) Transfer(ctx context.Context, in *pb.TransferRequest) (*pb.TransferResponse, error) {
+	resp, err := s.call(ctx, "Transfer", in, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.next.Transfer(ctx, req.(*pb.TransferRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.TransferResponse), nil
+}
+
+func (s *interceptedService) Release(ctx context.Context, in *pb.ReleaseRequest) (*pb.ReleaseResponse, error) {
+	resp, err := s.call(ctx, "Release", in, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.next.Release(ctx, req.(*pb.ReleaseRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.ReleaseResponse), nil
+}
+
+func (s *interceptedService) Describe(ctx context.Context, in *pb.DescribeRequest) (*pb.DescribeResponse, error) {
+	resp, err := s.call(ctx, "Describe", in, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.next.Describe(ctx, req.(*pb.DescribeRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.DescribeResponse), nil
+}
+
+func (s *interceptedService) List(ctx context.Context, in *pb.ListRequest) (*pb.ListResponse, error) {
+	resp, err := s.call(ctx, "List", in, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.next.List(ctx, req.(*pb.ListRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.ListResponse), nil
+}
+
+func (s *interceptedService) Put(ctx context.Context, in *pb.PutRequest) (*pb.PutResponse, error) {
+	resp, err := s.call(ctx, "Put", in, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.next.Put(ctx, req.(*pb.PutRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.PutResponse), nil
+}
+
+func (s *interceptedService) Get(ctx context.Context, in *pb.GetRequest) (*pb.GetResponse, error) {
+	resp, err := s.call(ctx, "Get", in, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.next.Get(ctx, req.(*pb.GetRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.GetResponse), nil
+}
+
+func (s *interceptedService) History(ctx context.Context, in *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	resp, err := s.call(ctx, "History", in, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.next.History(ctx, req.(*pb.HistoryRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.HistoryResponse), nil
+}
+
+// Watch is not served as HTTP/JSON, so it is passed through.
+func (s *interceptedService) Watch(in *pb.WatchRequest, stream pb.LockService_WatchServer) error {
+	return s.next.Watch(in, stream)
+}
@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gcp-services/lock/auth"
+	"github.com/gcp-services/lock/backends"
+	pb "github.com/gcp-services/lock/storage"
+)
+
+// stubService acquires every lock but "busy", returning its uuid and owner as its
+// token, and describes no lock.
+type stubService struct {
+	pb.LockServiceServer
+}
+
+func (stubService) TryLock(ctx context.Context, in *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	if in.Lock.Uuid == "busy" {
+		return nil, backends.ErrLockBusy
+	}
+	return &pb.TryLockResponse{Token: in.Lock.Uuid + " " + in.Lock.Owner}, nil
+}
+
+func (stubService) Describe(ctx context.Context, in *pb.DescribeRequest) (*pb.DescribeResponse, error) {
+	return nil, backends.ErrLockNotFound
+}
+
+func TestHandler(t *testing.T) {
+	interceptor := auth.UnaryServerInterceptor([]auth.Authenticator{auth.NewAPIKeys(map[string]string{"scheduler": "secret"})}, nil)
+	handler, err := NewHandler(context.Background(), auth.BindOwners(stubService{}, auth.OwnerDerive), interceptor)
+	if err != nil {
+		t.Fatalf("error creating handler: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	do := func(method, path, key, body string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error making request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var decoded map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+			t.Fatalf("error decoding response: %v", err)
+		}
+		return resp, decoded
+	}
+
+	// Uuids can contain slashes, and owners are derived from the principal.
+	resp, body := do("POST", "/v1/locks/jobs/daily:tryLock", "secret", `{"lock": {"expires": "2030-01-01T00:00:00Z"}}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected lock to be acquired, instead: %v %v", resp.Status, body)
+	}
+	if body["token"] != "jobs/daily scheduler" {
+		t.Fatalf("expected lock jobs/daily owned by scheduler, instead: %v", body)
+	}
+
+	for _, c := range []struct {
+		method, path, key, body string
+		status                  int
+	}{
+		{"POST", "/v1/locks/busy:tryLock", "secret", `{}`, http.StatusConflict},
+		{"GET", "/v1/locks/missing", "secret", ``, http.StatusNotFound},
+		{"POST", "/v1/locks/a:tryLock", "secret", `{"lock": {"owner": "billing"}}`, http.StatusForbidden},
+		{"POST", "/v1/locks/a:tryLock", "", `{}`, http.StatusUnauthorized},
+	} {
+		resp, body := do(c.method, c.path, c.key, c.body)
+		if resp.StatusCode != c.status {
+			t.Fatalf("expected %s %s to return %d, instead: %v %v", c.method, c.path, c.status, resp.Status, body)
+		}
+	}
+}
@@ -7,10 +7,20 @@ require (
 	cloud.google.com/go/spanner v1.8.0
 	github.com/golang/protobuf v1.4.2
 	github.com/google/uuid v1.1.1
+	github.com/grpc-ecosystem/grpc-gateway v1.14.6
+	github.com/prometheus/client_golang v1.7.0
 	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.7.1
+	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.13.0
+	go.opentelemetry.io/otel v0.13.0
+	go.opentelemetry.io/otel/exporters/otlp v0.13.0
+	go.opentelemetry.io/otel/exporters/stdout v0.13.0
+	go.opentelemetry.io/otel/sdk v0.13.0
+	go.uber.org/zap v1.16.0
 	google.golang.org/api v0.30.0
 	google.golang.org/genproto v0.0.0-20200804131852-c06518451d9c
-	google.golang.org/grpc v1.31.0
+	google.golang.org/grpc v1.32.0
 	google.golang.org/protobuf v1.25.0
+	gopkg.in/square/go-jose.v2 v2.4.0
+	gopkg.in/yaml.v2 v2.2.5
 )
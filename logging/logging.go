@@ -0,0 +1,151 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gcp-services/lock/backends"
+	pb "github.com/gcp-services/lock/storage"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Config configures a logger.
+type Config struct {
+	// Level is the minimum level of the entries logged: debug, info, warn or error.
+	Level string `mapstructure:"level"`
+
+	// Format is the encoding of entries: json or text.
+	Format string `mapstructure:"format"`
+
+	// SampleInitial is the number of entries with the same level and message
+	// logged every second before sampling starts. Sampling is disabled if zero.
+	SampleInitial int `mapstructure:"sample_initial"`
+
+	// SampleThereafter is the rate of the entries logged once sampling has started,
+	// one in every SampleThereafter.
+	SampleThereafter int `mapstructure:"sample_thereafter"`
+}
+
+// New creates a logger writing entries to stderr.
+func New(config Config) (*zap.Logger, error) {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", config.Level)
+	}
+
+	c := zap.NewProductionConfig()
+	c.Level = zap.NewAtomicLevelAt(level)
+	c.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	c.DisableStacktrace = true
+	switch config.Format {
+	case "json":
+		c.Encoding = "json"
+	case "text":
+		c.Encoding = "console"
+	default:
+		return nil, fmt.Errorf("invalid log format %q", config.Format)
+	}
+
+	c.Sampling = nil
+	if config.SampleInitial > 0 {
+		c.Sampling = &zap.SamplingConfig{
+			Initial:    config.SampleInitial,
+			Thereafter: config.SampleThereafter,
+		}
+	}
+	return c.Build()
+}
+
+// lockRequest is a request for a lock.
+type lockRequest interface {
+	GetLock() *pb.Lock
+}
+
+// uuidRequest is a request naming a lock by uuid.
+type uuidRequest interface {
+	GetUuid() string
+	GetNamespace() string
+}
+
+// nameRequest is a request for an election, barrier or latch.
+type nameRequest interface {
+	GetName() string
+}
+
+// requestFields returns the fields describing the lock req is for.
+func requestFields(req interface{}) []zap.Field {
+	switch in := req.(type) {
+	case lockRequest:
+		lock := in.GetLock()
+		fields := []zap.Field{zap.String("uuid", lock.GetUuid()), zap.String("owner", lock.GetOwner())}
+		if lock.GetNamespace() != "" {
+			fields = append(fields, zap.String("namespace", lock.GetNamespace()))
+		}
+		return fields
+	case uuidRequest:
+		fields := []zap.Field{zap.String("uuid", in.GetUuid())}
+		if in.GetNamespace() != "" {
+			fields = append(fields, zap.String("namespace", in.GetNamespace()))
+		}
+		return fields
+	case nameRequest:
+		return []zap.Field{zap.String("name", in.GetName())}
+	}
+	return nil
+}
+
+// peerAddress returns the address of the client of ctx.
+func peerAddress(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// logRequest logs the outcome of a request. Requests failing with an unexpected
+// error are logged as errors, and other failures as warnings, so that they are
+// sampled apart from successful requests.
+func logRequest(ctx context.Context, logger *zap.Logger, method string, start time.Time, err error, fields ...zap.Field) {
+	code := status.Code(backends.Status(err))
+	fields = append(fields,
+		zap.String("method", method),
+		zap.String("code", code.String()),
+		zap.Duration("latency", time.Since(start)),
+		zap.String("peer", peerAddress(ctx)),
+	)
+
+	switch code {
+	case codes.OK:
+		logger.Info("request", fields...)
+	case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss:
+		logger.Error("request failed", append(fields, zap.Error(err))...)
+	default:
+		logger.Warn("request rejected", append(fields, zap.Error(err))...)
+	}
+}
+
+// UnaryServerInterceptor logs every request with logger.
+func UnaryServerInterceptor(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		logRequest(ctx, logger, info.FullMethod, start, err, requestFields(req)...)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor logs every stream with logger once it ends.
+func StreamServerInterceptor(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		logRequest(ss.Context(), logger, info.FullMethod, start, err)
+		return err
+	}
+}
@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/gcp-services/lock/backends"
+	pb "github.com/gcp-services/lock/storage"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	interceptor := UnaryServerInterceptor(zap.New(core).With(zap.String("backend", "spanner")))
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}})
+	info := &grpc.UnaryServerInfo{FullMethod: "/storage.LockService/TryLock"}
+	req := &pb.TryLockRequest{Lock: &pb.Lock{Uuid: "a", Owner: "scheduler", Namespace: "jobs"}}
+
+	for _, c := range []struct {
+		err     error
+		level   zapcore.Level
+		message string
+		code    string
+	}{
+		{nil, zapcore.InfoLevel, "request", "OK"},
+		{backends.ErrLockBusy, zapcore.WarnLevel, "request rejected", "Aborted"},
+		{fmt.Errorf("spanner unreachable"), zapcore.ErrorLevel, "request failed", "Unknown"},
+	} {
+		interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, c.err
+		})
+
+		entries := logs.TakeAll()
+		if len(entries) != 1 {
+			t.Fatalf("expected a single entry, instead: %v", entries)
+		}
+		entry := entries[0]
+		if entry.Level != c.level || entry.Message != c.message {
+			t.Fatalf("expected %v %q, instead: %v %q", c.level, c.message, entry.Level, entry.Message)
+		}
+
+		fields := entry.ContextMap()
+		for key, value := range map[string]interface{}{
+			"backend":   "spanner",
+			"method":    "/storage.LockService/TryLock",
+			"uuid":      "a",
+			"owner":     "scheduler",
+			"namespace": "jobs",
+			"peer":      "10.0.0.1:4000",
+			"code":      c.code,
+		} {
+			if fields[key] != value {
+				t.Fatalf("expected %s to be %v, instead: %v", key, value, fields[key])
+			}
+		}
+		if _, ok := fields["latency"]; !ok {
+			t.Fatalf("expected latency to be logged, instead: %v", fields)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, c := range []struct {
+		config Config
+		err    bool
+	}{
+		{Config{Level: "debug", Format: "json", SampleInitial: 100, SampleThereafter: 100}, false},
+		{Config{Level: "info", Format: "text"}, false},
+		{Config{Level: "loud", Format: "json"}, true},
+		{Config{Level: "info", Format: "xml"}, true},
+	} {
+		if _, err := New(c.config); (err != nil) != c.err {
+			t.Fatalf("expected %+v to fail: %v, instead: %v", c.config, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// modified returns the latest modification time of files.
+func modified(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// keyPair is a certificate and its key, reloaded when either file changes so that
+// certificates can be rotated without restarting the server.
+type keyPair struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// load returns the certificate, reloading it if its files have changed. The
+// previous certificate is kept if the files can't be loaded, such as while they
+// are being rewritten.
+func (k *keyPair) load() (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	changed, err := modified(k.certFile, k.keyFile)
+	if err == nil && k.cert != nil && changed.Equal(k.modified) {
+		return k.cert, nil
+	}
+
+	cert, loadErr := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err == nil {
+		err = loadErr
+	}
+	if err != nil {
+		if k.cert != nil {
+			return k.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load certificate %s: %v", k.certFile, err)
+	}
+
+	k.cert, k.modified = &cert, changed
+	return k.cert, nil
+}
+
+// certPool is a pool of CA certificates, reloaded when its file changes.
+type certPool struct {
+	file string
+
+	mu       sync.Mutex
+	pool     *x509.CertPool
+	modified time.Time
+}
+
+// load returns the pool, reloading it if its file has changed. The previous pool
+// is kept if the file can't be loaded.
+func (c *certPool) load() (*x509.CertPool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed, err := modified(c.file)
+	if err == nil && c.pool != nil && changed.Equal(c.modified) {
+		return c.pool, nil
+	}
+
+	var pem []byte
+	if err == nil {
+		pem, err = ioutil.ReadFile(c.file)
+	}
+	pool := x509.NewCertPool()
+	if err == nil && !pool.AppendCertsFromPEM(pem) {
+		err = fmt.Errorf("no certificates found")
+	}
+	if err != nil {
+		if c.pool != nil {
+			return c.pool, nil
+		}
+		return nil, fmt.Errorf("failed to load CA certificates %s: %v", c.file, err)
+	}
+
+	c.pool, c.modified = pool, changed
+	return c.pool, nil
+}
+
+// ServerConfig returns the TLS configuration of a server presenting the
+// certificate in certFile and keyFile. If clientCAFile is set, clients must
+// present a certificate signed by one of the CAs in it.
+func ServerConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert := &keyPair{certFile: certFile, keyFile: keyFile}
+	if _, err := cert.load(); err != nil {
+		return nil, err
+	}
+
+	var clientCAs *certPool
+	if clientCAFile != "" {
+		clientCAs = &certPool{file: clientCAFile}
+		if _, err := clientCAs.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Every connection is configured with the certificates currently on disk.
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := cert.load()
+			if err != nil {
+				return nil, err
+			}
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if clientCAs != nil {
+				pool, err := clientCAs.load()
+				if err != nil {
+					return nil, err
+				}
+				config.ClientCAs = pool
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}, nil
+}
+
+// ClientConfig returns the TLS configuration of a client connecting to a lock
+// server. If caFile is set, the server certificate must be signed by one of the
+// CAs in it, instead of the CAs of the system. If certFile and keyFile are set,
+// the client presents their certificate to servers requiring one.
+func ClientConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := (&certPool{file: caFile}).load()
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert := &keyPair{certFile: certFile, keyFile: keyFile}
+		if _, err := cert.load(); err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.load()
+		}
+	}
+
+	return config, nil
+}
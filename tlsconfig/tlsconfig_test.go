@@ -0,0 +1,167 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issuer signs test certificates.
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate with serial, signed by i or self-signed if i is nil,
+// and writes it and its key to dir as name.crt and name.key.
+func issue(t *testing.T, i *issuer, dir, name string, serial int64, isCA bool) *issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if i != nil {
+		parent, signer = i.cert, i.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error marshalling key: %v", err)
+	}
+
+	write := func(file, blockType string, bytes []byte) {
+		path := filepath.Join(dir, file)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes}), 0600); err != nil {
+			t.Fatalf("error writing %s: %v", file, err)
+		}
+		// Make sure rewritten files are seen as modified.
+		modTime := time.Now().Add(time.Duration(serial) * time.Second)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("error touching %s: %v", file, err)
+		}
+	}
+	write(name+".crt", "CERTIFICATE", der)
+	write(name+".key", "EC PRIVATE KEY", keyDer)
+
+	return &issuer{cert: cert, key: key}
+}
+
+// handshake connects to l with config and returns the serial of the server
+// certificate.
+func handshake(l net.Listener, config *tls.Config) (int64, error) {
+	// The server completes the handshake once it is read from, and echoes a byte.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 1)
+		if _, err := conn.Read(b); err == nil {
+			conn.Write(b)
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), config)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// Client certificates are verified by the server after the client completes
+	// its side of the handshake, so wait for the server to answer.
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		return 0, err
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsconfig")
+	if err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := issue(t, nil, dir, "ca", 1, true)
+	issue(t, ca, dir, "server", 2, false)
+	issue(t, ca, dir, "client", 3, false)
+	path := func(file string) string {
+		return filepath.Join(dir, file)
+	}
+
+	server, err := ServerConfig(path("server.crt"), path("server.key"), path("ca.crt"))
+	if err != nil {
+		t.Fatalf("error creating server config: %v", err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+
+	client, err := ClientConfig(path("client.crt"), path("client.key"), path("ca.crt"))
+	if err != nil {
+		t.Fatalf("error creating client config: %v", err)
+	}
+	serial, err := handshake(l, client)
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	if serial != 2 {
+		t.Fatalf("expected server certificate 2, instead: %v", serial)
+	}
+
+	// Clients without a certificate are rejected.
+	anonymous, err := ClientConfig("", "", path("ca.crt"))
+	if err != nil {
+		t.Fatalf("error creating client config: %v", err)
+	}
+	if _, err := handshake(l, anonymous); err == nil {
+		t.Fatalf("expected client without a certificate to be rejected")
+	}
+
+	// Rotated certificates are used for new connections.
+	issue(t, ca, dir, "server", 4, false)
+	serial, err = handshake(l, client)
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	if serial != 4 {
+		t.Fatalf("expected rotated server certificate 4, instead: %v", serial)
+	}
+}